@@ -5,11 +5,24 @@ import "fmt"
 // CreateTables creates all tables required for the app.
 func (s *Store) CreateTables() error {
 	tableFuncs := map[string]func() error{
-		"sessions": s.createSessionsTable,
-		"users":    s.createUsersTable,
-		"songs":    s.createSongsTable,
-		"votes":    s.createVotesTable,
-		"vetoes":   s.createVetoesTable,
+		"sessions":  s.createSessionsTable,
+		"users":     s.createUsersTable,
+		"songs":     s.createSongsTable,
+		"votes":     s.createVotesTable,
+		"vetoes":    s.createVetoesTable,
+		"rounds":    s.createRoundsTable,
+		"ballots":   s.createBallotsTable,
+		"overrides": s.createOverridesTable,
+		"groups":    s.createGroupsTable,
+		"members":   s.createGroupMembersTable,
+		"settings":  s.createSettingsTable,
+		"invites":   s.createInvitesTable,
+		"logins":    s.createLoginFailuresTable,
+		"tokens":    s.createAPITokensTable,
+		"identity":  s.createUserIdentitiesTable,
+		"resets":    s.createPasswordResetsTable,
+		"devices":   s.createUserSessionsTable,
+		"audit":     s.createAuditLogTable,
 	}
 
 	for name, tf := range tableFuncs {
@@ -18,9 +31,106 @@ func (s *Store) CreateTables() error {
 		}
 	}
 
+	for _, c := range migrationColumns() {
+		if err := s.addColumn(c.table, c.name, c.definition); err != nil {
+			return fmt.Errorf("error adding column %q to table %q: %v", c.name, c.table, err)
+		}
+	}
+
+	if err := s.createVotesIndex(); err != nil {
+		return fmt.Errorf("error creating votes index: %v", err)
+	}
+
+	if err := s.createSongsIndex(); err != nil {
+		return fmt.Errorf("error creating songs index: %v", err)
+	}
+
+	if err := s.createDefaultGroup(); err != nil {
+		return fmt.Errorf("error creating default group: %v", err)
+	}
+
+	if err := s.createFirstRounds(); err != nil {
+		return fmt.Errorf("error creating first rounds: %v", err)
+	}
+
+	if err := s.assignRoundlessSongs(); err != nil {
+		return fmt.Errorf("error assigning songs to rounds: %v", err)
+	}
+
+	if err := s.createDefaultAdmin(); err != nil {
+		return fmt.Errorf("error creating default admin: %v", err)
+	}
+
 	return nil
 }
 
+// column is a column added to a table after the first release.
+type column struct{ table, name, definition string }
+
+// migrationColumns returns the columns added after the first release, for
+// databases created before they existed.
+func migrationColumns() []column {
+	columns := []column{
+		{"songs", "round_id", "INTEGER REFERENCES rounds(id)"},
+		{"rounds", "voting_method", "TEXT NOT NULL DEFAULT 'approval'"},
+		{"rounds", "vote_budget", fmt.Sprintf("INTEGER NOT NULL DEFAULT %d", defaultVoteBudget)},
+		{"rounds", "veto_override_fraction",
+			fmt.Sprintf("REAL NOT NULL DEFAULT %g", defaultVetoOverrideFraction)},
+		{"rounds", "veto_override_refund", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"vetoes", "overridden", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"rounds", "group_id", fmt.Sprintf("INTEGER NOT NULL DEFAULT %d", defaultGroupID)},
+		{"songs", "group_id", fmt.Sprintf("INTEGER NOT NULL DEFAULT %d", defaultGroupID)},
+		{"users", "admin", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"users", "session_version", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	// Rows from before timestamps were tracked keep them null.
+	for _, table := range []string{"users", "songs", "votes", "vetoes"} {
+		for _, name := range []string{"created_at", "updated_at", "deleted_at"} {
+			columns = append(columns, column{table, name, "DATETIME"})
+		}
+	}
+
+	return columns
+}
+
+// CheckMigrations returns an error if a column added after the first release
+// is missing from the db.
+func (s *Store) CheckMigrations() error {
+	for _, c := range migrationColumns() {
+		exists, err := s.columnExists(c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("column %q missing from table %q", c.name, c.table)
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table if it doesn't have it yet.
+func (s *Store) addColumn(table, name, definition string) error {
+	exists, err := s.columnExists(table, name)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, definition))
+	return err
+}
+
+// columnExists reports whether a table has the named column.
+func (s *Store) columnExists(table, name string) (bool, error) {
+	var count int
+	row := s.db.QueryRow(
+		"SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, name)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 // createSessionsTable creates the sessions table in the db if it doesn't exist.
 func (s *Store) createSessionsTable() error {
 	_, err := s.db.Exec(
@@ -41,7 +151,11 @@ func (s *Store) createUsersTable() error {
 			name TEXT NOT NULL,
 			password TEXT NOT NULL,
 			inactive BOOLEAN,
-			vetoes INTEGER
+			admin BOOLEAN NOT NULL DEFAULT FALSE,
+			session_version INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME,
+			updated_at DATETIME,
+			deleted_at DATETIME
 		);`)
 	return err
 }
@@ -57,7 +171,14 @@ func (s *Store) createSongsTable() error {
 			votes INTEGER,
 			vetoed BOOLEAN,
 			added_by INTEGER NOT NULL,
-			FOREIGN KEY(added_by) REFERENCES users(id)
+			round_id INTEGER,
+			group_id INTEGER NOT NULL,
+			created_at DATETIME,
+			updated_at DATETIME,
+			deleted_at DATETIME,
+			FOREIGN KEY(added_by) REFERENCES users(id),
+			FOREIGN KEY(round_id) REFERENCES rounds(id),
+			FOREIGN KEY(group_id) REFERENCES groups(id)
 		);`)
 	return err
 }
@@ -69,21 +190,362 @@ func (s *Store) createVotesTable() error {
 			id INTEGER PRIMARY KEY,
 			song_id INTEGER NOT NULL,
 			user_id INTEGER NOT NULL,
+			created_at DATETIME,
+			updated_at DATETIME,
+			deleted_at DATETIME,
 			FOREIGN KEY(song_id) REFERENCES songs(id),
 			FOREIGN KEY(user_id) REFERENCES users(id)
 		);`)
 	return err
 }
 
+// createVotesIndex makes sure a user has at most one live vote per song. It is
+// created after the migrations since older votes tables lack deleted_at.
+func (s *Store) createVotesIndex() error {
+	_, err := s.db.Exec(
+		`CREATE UNIQUE INDEX IF NOT EXISTS votes_live_idx ON votes(song_id, user_id)
+		WHERE deleted_at IS NULL;`)
+	return err
+}
+
+// createSongsIndex indexes songs by group. It is created after the migrations
+// since older songs tables lack group_id.
+func (s *Store) createSongsIndex() error {
+	_, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS songs_group_idx ON songs(group_id);`)
+	return err
+}
+
 // createVetoesTable creates the vetoes table in the db if it doesn't exist.
 func (s *Store) createVetoesTable() error {
 	_, err := s.db.Exec(
 		`CREATE TABLE IF NOT EXISTS vetoes (
+			id INTEGER PRIMARY KEY,
+			song_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			overridden BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at DATETIME,
+			updated_at DATETIME,
+			deleted_at DATETIME,
+			FOREIGN KEY(song_id) REFERENCES songs(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`)
+	return err
+}
+
+// createRoundsTable creates the rounds table in the db if it doesn't exist.
+func (s *Store) createRoundsTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS rounds (
+			id INTEGER PRIMARY KEY,
+			closed BOOLEAN,
+			voting_method TEXT NOT NULL DEFAULT 'approval',
+			vote_budget INTEGER NOT NULL DEFAULT %d,
+			veto_override_fraction REAL NOT NULL DEFAULT %g,
+			veto_override_refund BOOLEAN NOT NULL DEFAULT FALSE,
+			group_id INTEGER NOT NULL,
+			FOREIGN KEY(group_id) REFERENCES groups(id)
+		);`, defaultVoteBudget, defaultVetoOverrideFraction))
+	return err
+}
+
+// createBallotsTable creates the ballots table in the db if it doesn't exist.
+// Each row is one choice on a user's ballot, with rank 1 the most preferred.
+func (s *Store) createBallotsTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS ballots (
+			id INTEGER PRIMARY KEY,
+			round_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			song_id INTEGER NOT NULL,
+			rank INTEGER NOT NULL,
+			FOREIGN KEY(round_id) REFERENCES rounds(id),
+			FOREIGN KEY(user_id) REFERENCES users(id),
+			FOREIGN KEY(song_id) REFERENCES songs(id)
+		);
+		CREATE INDEX IF NOT EXISTS ballots_round_idx ON ballots(round_id, user_id);`)
+	return err
+}
+
+// createOverridesTable creates the overrides table in the db if it doesn't
+// exist. Each row is a user's vote to lift the veto of a song, and users vote
+// at most once per song. Duplicate votes recorded before that was enforced are
+// dropped so the unique index can be created.
+func (s *Store) createOverridesTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS overrides (
 			id INTEGER PRIMARY KEY,
 			song_id INTEGER NOT NULL,
 			user_id INTEGER NOT NULL,
 			FOREIGN KEY(song_id) REFERENCES songs(id),
 			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		DELETE FROM overrides WHERE id NOT IN
+			(SELECT MIN(id) FROM overrides GROUP BY song_id, user_id);
+		CREATE UNIQUE INDEX IF NOT EXISTS overrides_song_user_idx
+			ON overrides(song_id, user_id);`)
+	return err
+}
+
+// createGroupsTable creates the groups table in the db if it doesn't exist.
+func (s *Store) createGroupsTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS groups (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			invite_code TEXT NOT NULL UNIQUE,
+			veto_allowance INTEGER NOT NULL,
+			song_quota INTEGER NOT NULL,
+			voting_method TEXT NOT NULL
+		);`)
+	return err
+}
+
+// createGroupMembersTable creates the group_members table in the db if it
+// doesn't exist. Members' remaining vetoes and votes are kept per group.
+func (s *Store) createGroupMembersTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS group_members (
+			group_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			role TEXT NOT NULL,
+			vetoes INTEGER NOT NULL,
+			votes_remaining INTEGER NOT NULL,
+			PRIMARY KEY(group_id, user_id),
+			FOREIGN KEY(group_id) REFERENCES groups(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`)
+	return err
+}
+
+// createSettingsTable creates the settings table in the db if it doesn't
+// exist. Each row is an instance-wide setting changed by admins.
+func (s *Store) createSettingsTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS settings (
+			name TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`)
+	return err
+}
+
+// createInvitesTable creates the invites and invite_redemptions tables in the
+// db if they don't exist. Redemptions record which user registered with which
+// invite.
+func (s *Store) createInvitesTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS invites (
+			id INTEGER PRIMARY KEY,
+			token TEXT NOT NULL UNIQUE,
+			created_by INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			single_use BOOLEAN NOT NULL,
+			expires_at DATETIME,
+			FOREIGN KEY(created_by) REFERENCES users(id)
+		);
+		CREATE TABLE IF NOT EXISTS invite_redemptions (
+			invite_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			redeemed_at DATETIME NOT NULL,
+			PRIMARY KEY(invite_id, user_id),
+			FOREIGN KEY(invite_id) REFERENCES invites(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`)
+	return err
+}
+
+// createLoginFailuresTable creates the login_failures table in the db if it
+// doesn't exist. Failed logins are counted per user name and per address.
+func (s *Store) createLoginFailuresTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			kind TEXT NOT NULL,
+			key TEXT NOT NULL,
+			failures INTEGER NOT NULL,
+			last_failure DATETIME NOT NULL,
+			locked_until DATETIME,
+			PRIMARY KEY(kind, key)
+		);`)
+	return err
+}
+
+// createAPITokensTable creates the api_tokens table in the db if it doesn't
+// exist. Tokens are stored as SHA-256 hashes and scopes as a comma-separated
+// list.
+func (s *Store) createAPITokensTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`)
+	return err
+}
+
+// createUserIdentitiesTable creates the user_identities table in the db if it
+// doesn't exist. Each row links a user to their account at an OpenID Connect
+// provider.
+func (s *Store) createUserIdentitiesTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			PRIMARY KEY(issuer, subject),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`)
+	return err
+}
+
+// createPasswordResetsTable creates the password_resets table in the db if it
+// doesn't exist. Reset tokens are stored as SHA-256 hashes.
+func (s *Store) createPasswordResetsTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_by INTEGER NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used BOOLEAN NOT NULL DEFAULT FALSE,
+			FOREIGN KEY(user_id) REFERENCES users(id),
+			FOREIGN KEY(created_by) REFERENCES users(id)
 		);`)
 	return err
 }
+
+// createUserSessionsTable creates the user_sessions table in the db if it
+// doesn't exist. Each row describes a logged in session; deleting the row
+// logs the session out.
+func (s *Store) createUserSessionsTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS user_sessions (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);
+		CREATE INDEX IF NOT EXISTS user_sessions_user_idx ON user_sessions(user_id);`)
+	return err
+}
+
+// createAuditLogTable creates the audit_log table in the db if it doesn't
+// exist. Triggers keep the log append-only: entries can't be deleted, and only
+// their before and after snapshots can be changed, so that EraseUser can
+// redact the snapshots of erased users.
+func (s *Store) createAuditLogTable() error {
+	_, err := s.db.Exec(
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY,
+			created_at DATETIME NOT NULL,
+			actor_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id INTEGER NOT NULL,
+			before TEXT,
+			after TEXT,
+			request_id TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log(actor_id);
+		CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log(target_type, target_id);
+		DROP TRIGGER IF EXISTS audit_log_no_update;
+		CREATE TRIGGER audit_log_no_update
+		BEFORE UPDATE OF id, created_at, actor_id, action, target_type, target_id, request_id
+		ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;
+		CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;`)
+	return err
+}
+
+// createDefaultGroup creates the group every user belongs to, and adds users
+// created before groups existed to it.
+func (s *Store) createDefaultGroup() error {
+	code, err := newInviteCode()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT OR IGNORE INTO groups(id, name, invite_code, veto_allowance, song_quota,
+			voting_method)
+		VALUES($1, $2, $3, $4, $5, $6)`,
+		defaultGroupID, defaultGroupName, code, initialVetoes, defaultSongQuota, MethodApproval)
+	if err != nil {
+		return err
+	}
+
+	// Users from before groups keep the vetoes and votes they had left on the
+	// users table.
+	vetoes, err := s.columnOr("users", "vetoes", initialVetoes)
+	if err != nil {
+		return err
+	}
+	votes, err := s.columnOr("users", "votes_remaining", defaultVoteBudget)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(
+		`INSERT OR IGNORE INTO group_members(group_id, user_id, role, vetoes, votes_remaining)
+		SELECT $1, id, $2, %s, %s FROM users`, vetoes, votes),
+		defaultGroupID, RoleMember)
+	return err
+}
+
+// columnOr returns an expression for a column of an older table, falling back
+// to a default when the column or its value is missing.
+func (s *Store) columnOr(table, name string, fallback int) (string, error) {
+	exists, err := s.columnExists(table, name)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return fmt.Sprint(fallback), nil
+	}
+	return fmt.Sprintf("COALESCE(%s, %d)", name, fallback), nil
+}
+
+// createFirstRounds starts a round in groups without an open round, such as
+// the default group of a new db.
+func (s *Store) createFirstRounds() error {
+	_, err := s.db.Exec(
+		`INSERT INTO rounds(group_id, closed, voting_method, vote_budget,
+			veto_override_fraction, veto_override_refund)
+		SELECT id, FALSE, voting_method, $1, $2, FALSE FROM groups
+		WHERE NOT EXISTS (
+			SELECT 1 FROM rounds WHERE rounds.group_id = groups.id AND closed = FALSE)`,
+		defaultVoteBudget, defaultVetoOverrideFraction)
+	return err
+}
+
+// assignRoundlessSongs puts songs added before rounds existed in the first
+// round of their group, so they can still be voted on.
+func (s *Store) assignRoundlessSongs() error {
+	_, err := s.db.Exec(
+		`UPDATE songs SET round_id =
+			(SELECT MIN(id) FROM rounds WHERE rounds.group_id = songs.group_id)
+		WHERE round_id IS NULL`)
+	return err
+}
+
+// createDefaultAdmin makes the first user an admin if there is no admin yet,
+// for databases created before admins existed.
+func (s *Store) createDefaultAdmin() error {
+	_, err := s.db.Exec(
+		`UPDATE users SET admin = TRUE
+		WHERE id = (SELECT MIN(id) FROM users)
+			AND NOT EXISTS (SELECT 1 FROM users WHERE admin = TRUE)`)
+	return err
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"strconv"
 )
 
 const (
@@ -10,10 +15,93 @@ const (
 )
 
 func main() {
+	// Logs are written as text or JSON records if SONGVOTE_LOG_FORMAT says so.
+	if err := configureLogging(os.Getenv("SONGVOTE_LOG_FORMAT")); err != nil {
+		log.Fatal(err)
+	}
+
+	// Spans are exported to stdout or an OTLP collector if
+	// SONGVOTE_TRACE_EXPORTER says so.
+	shutdownTracing, err := configureTracing(os.Getenv("SONGVOTE_TRACE_EXPORTER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	store, err := NewStore(dbFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 	server := NewServer(port, store)
-	log.Fatal(server.ListenAndServe())
+
+	// The session cookie is sent over HTTPS only if SONGVOTE_COOKIE_SECURE is
+	// true, such as when serving behind a TLS proxy.
+	secure := false
+	if value := os.Getenv("SONGVOTE_COOKIE_SECURE"); value != "" {
+		if secure, err = strconv.ParseBool(value); err != nil {
+			log.Fatalf("invalid SONGVOTE_COOKIE_SECURE %q: %v", value, err)
+		}
+	}
+	server.ConfigureCookie(CookieConfig{
+		Name:   os.Getenv("SONGVOTE_COOKIE_NAME"),
+		Domain: os.Getenv("SONGVOTE_COOKIE_DOMAIN"),
+		Secure: secure,
+	})
+
+	// The app is served over HTTPS if given a certificate and key, redirecting
+	// HTTP requests from SONGVOTE_HTTP_REDIRECT_ADDR if set.
+	if certFile := os.Getenv("SONGVOTE_TLS_CERT"); certFile != "" {
+		config := TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      os.Getenv("SONGVOTE_TLS_KEY"),
+			RedirectAddr: os.Getenv("SONGVOTE_HTTP_REDIRECT_ADDR"),
+		}
+		if version := os.Getenv("SONGVOTE_TLS_MIN_VERSION"); version != "" {
+			if config.MinVersion, err = ParseTLSVersion(version); err != nil {
+				log.Fatal(err)
+			}
+		}
+		server.EnableTLS(config)
+	}
+
+	// Rate limits can be changed with JSON in SONGVOTE_RATE_LIMITS, such as
+	// {"routes": {"POST /api/user": {"per_minute": 1, "burst": 3}}}.
+	if limits := os.Getenv("SONGVOTE_RATE_LIMITS"); limits != "" {
+		config, err := ParseRateLimitConfig(limits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.SetRateLimits(config)
+	}
+
+	// Single sign-on is enabled by setting the provider's issuer URL.
+	if issuer := os.Getenv("SONGVOTE_OIDC_ISSUER"); issuer != "" {
+		server.EnableOIDC(OIDCConfig{
+			Issuer:       issuer,
+			ClientID:     os.Getenv("SONGVOTE_OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("SONGVOTE_OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("SONGVOTE_OIDC_REDIRECT_URL"),
+		})
+	}
+
+	err = server.ListenAndServe()
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("error flushing spans", "error", err)
+	}
+	log.Fatal(err)
+}
+
+// configureLogging sets the default logger to write "text" or "json" records
+// to stderr. An empty format keeps the standard log output.
+func configureLogging(format string) error {
+	switch format {
+	case "":
+		return nil
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	return nil
 }
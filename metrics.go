@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the latency histograms, in seconds.
+var (
+	httpDurationBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	queryDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+// Metrics of the app, exposed at /metrics in the Prometheus text format.
+var (
+	httpRequests = newCounterVec("songvote_http_requests_total",
+		"HTTP requests handled, by route, method and status code.",
+		"route", "method", "status")
+	httpDuration = newHistogramVec("songvote_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route and method.",
+		httpDurationBuckets, "route", "method")
+	queryDuration = newHistogramVec("songvote_db_query_duration_seconds",
+		"Time taken by database queries, by statement kind.",
+		queryDurationBuckets, "statement")
+	songsAdded   = newCounterVec("songvote_songs_added_total", "Songs added.")
+	votesCast    = newCounterVec("songvote_votes_total", "Votes cast for songs.")
+	vetoesCast   = newCounterVec("songvote_vetoes_total", "Vetoes cast on songs.")
+	roundsClosed = newCounterVec("songvote_rounds_closed_total", "Voting rounds closed.")
+)
+
+// metricsHandler writes the app metrics and the number of active sessions in
+// the Prometheus text exposition format.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.store.CountActiveSessions(time.Now().Add(-sessionLifetime))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics := []interface{ write(io.Writer) }{
+		httpRequests, httpDuration, queryDuration, songsAdded, votesCast, vetoesCast,
+		roundsClosed,
+		gauge{"songvote_active_sessions", "Logged in sessions seen within the session lifetime.",
+			float64(sessions)},
+	}
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// counterVec is a counter with a value for each combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by label values joined with labelSeparator
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// inc adds one to the counter with the given label values.
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %g\n", c.name, c.values[""])
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, splitKey(key)), c.values[key])
+	}
+}
+
+// histogramVec is a histogram with a series for each combination of label
+// values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+	mu         sync.Mutex
+	series     map[string]*histogram // by label values joined with labelSeparator
+}
+
+// histogram counts observations in buckets, each counting the observations
+// up to its upper bound.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+}
+
+// observe records a value in the histogram with the given label values.
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, labelSeparator)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		values := splitKey(key)
+		bucketLabels := append(slices.Clone(h.labels), "le")
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(bucketLabels, append(slices.Clone(values), fmt.Sprint(bound))),
+				series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(bucketLabels, append(slices.Clone(values), "+Inf")), series.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, values), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), series.count)
+	}
+}
+
+// gauge is a value measured when metrics are scraped.
+type gauge struct {
+	name, help string
+	value      float64
+}
+
+func (g gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name,
+		g.value)
+}
+
+// labelSeparator joins label values into map keys. It can't appear in label
+// values, which are routes, methods, status codes and SQL keywords.
+const labelSeparator = "\x00"
+
+// splitKey returns the label values joined into a map key.
+func splitKey(key string) []string {
+	return strings.Split(key, labelSeparator)
+}
+
+// formatLabels returns the label set of a series, such as {a="1",b="2"}.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sortedKeys returns the keys of a map in order, so series are written in the
+// same order on every scrape.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
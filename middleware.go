@@ -1,14 +1,375 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestInfo is what logRequests keeps about a request while it is handled.
+type requestInfo struct {
+	id     string
+	logger *slog.Logger // logger that includes the request and trace IDs
+	userID int64        // user of the request's API token, if any
+}
+
+// logRequests gives each request an ID, a span and a logger that includes
+// both, and logs the request and records its metrics once it is handled. The
+// ID is taken from the X-Request-ID header if it is valid, and sent back in
+// the same header. The span continues the trace of a traceparent header.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		route := routeName(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethod(r.Method), semconv.HTTPRoute(route),
+				requestIDKey.String(id)))
+
+		logger := slog.Default().With("request_id", id)
+		if sc := span.SpanContext(); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+		}
+
+		info := &requestInfo{id: id, logger: logger}
+		r = r.WithContext(context.WithValue(ctx, requestInfoKey, info))
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		userID := info.userID
+		if userID == 0 {
+			userID = s.sessionManager.GetInt64(r.Context(), "user_id")
+		}
+		endRequestSpan(span, rec.status, userID)
+
+		httpRequests.inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.observe(duration.Seconds(), route, r.Method)
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		info.logger.Log(r.Context(), level, "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", duration,
+			"user_id", userID,
+			"remote_addr", remoteIP(r))
+	})
+}
+
+// routeVarPattern matches the pattern of a route variable, such as
+// ":[0-9]+" in {gid:[0-9]+}.
+var routeVarPattern = regexp.MustCompile(`:[^{}]*}`)
+
+// routeName returns the path template of the request's route without the
+// patterns of its variables, such as /api/group/{gid}/song, or "unmatched"
+// outside the router.
+func routeName(r *http.Request) string {
+	current := mux.CurrentRoute(r)
+	if current == nil {
+		return "unmatched"
+	}
+	template, err := current.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return routeVarPattern.ReplaceAllString(template, "}")
+}
+
+// validRequestID reports whether a request ID sent by a client can be used:
+// up to 64 letters, digits, dots, dashes and underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune(".-_", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder records the status code and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestID returns the ID logRequests gave the request, if any.
+func requestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// logger returns the logger of the request, or the default logger outside
+// requests.
+func logger(ctx context.Context) *slog.Logger {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// storeFor returns the store to use for a request, logging to the request's
+// logger.
+func (s *Server) storeFor(r *http.Request) *Store {
+	return s.store.WithRequest(r.Context(), logger(r.Context()))
+}
+
+// Request context keys.
+const (
+	csrfTokenKey   contextKey = "csrf_token" // also the session key of the token
+	apiTokenKey    contextKey = "api_token"
+	requestInfoKey contextKey = "request_info"
+	cspNonceKey    contextKey = "csp_nonce"
 )
 
-// logRequests prints incoming requests to the log.
-func logRequests(next http.Handler) http.Handler {
+// contextKey is the type of request context keys set by middleware.
+type contextKey string
+
+// csrfProtect rejects state-changing requests that don't carry the CSRF token
+// of the session, in the X-CSRF-Token header or the csrf_token form value.
+// The token is created with the session and added to the request context for
+// templates.
+func (s *Server) csrfProtect(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		slog.Info("Incoming HTTP request", "method", r.Method, "path", r.URL.Path)
+		// Requests made with API tokens don't carry the session cookie, so
+		// other sites can't forge them.
+		if apiToken(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := s.sessionManager.GetString(r.Context(), string(csrfTokenKey))
+		if token == "" {
+			var err error
+			token, err = randomToken()
+			if err != nil {
+				writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+			s.sessionManager.Put(r.Context(), string(csrfTokenKey), token)
+		}
+
+		if !safeMethod(r.Method) {
+			sent := r.Header.Get("X-CSRF-Token")
+			if sent == "" {
+				sent = r.PostFormValue(string(csrfTokenKey))
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				logger(r.Context()).Warn("Rejected request with invalid CSRF token",
+					"method", r.Method, "path", r.URL.Path)
+				writeError(w, ErrCSRF)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), csrfTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// csrfToken returns the CSRF token added to ctx by csrfProtect.
+func csrfToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfTokenKey).(string)
+	return token
+}
+
+// randomToken returns a random URL-safe token, for CSRF tokens and other
+// secrets.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkSession logs out sessions that were revoked, started before the
+// user's password was last changed, or whose user is no longer active, and
+// records when the other sessions were last seen.
+func (s *Server) checkSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID := s.sessionManager.GetInt64(ctx, "user_id")
+		if userID != 0 && apiToken(ctx) == nil {
+			active, err := s.storeFor(r).TouchSession(userID, s.sessionManager.GetInt64(ctx, "session_id"))
+			if err != nil {
+				writeError(w, err.(ServerError))
+				return
+			}
+
+			user, err := s.storeFor(r).GetUserByID(userID)
+			if !active || err != nil ||
+				user.SessionVersion != s.sessionManager.GetInt(ctx, "session_version") {
+				logger(r.Context()).Info("Ended outdated session", "user_id", userID)
+				for _, key := range sessionUserKeys {
+					s.sessionManager.Remove(ctx, key)
+				}
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// sessionUserKeys are the session keys set when a user logs in.
+var sessionUserKeys = []string{"user_id", "username", "session_version", "session_id"}
+
+// startSession logs the user in to the session of the request, renewing its
+// token and recording it for the user to see.
+func (s *Server) startSession(r *http.Request, user *User) error {
+	if err := s.sessionManager.RenewToken(r.Context()); err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	sessionID, err := s.storeFor(r).CreateSession(user.ID, r.UserAgent(), remoteIP(r))
+	if err != nil {
+		return err
+	}
+
+	s.sessionManager.Put(r.Context(), "user_id", user.ID)
+	s.sessionManager.Put(r.Context(), "username", user.Name)
+	s.sessionManager.Put(r.Context(), "session_version", user.SessionVersion)
+	s.sessionManager.Put(r.Context(), "session_id", sessionID)
+	return nil
+}
+
+// authenticate lets requests with an "Authorization: Bearer" header act as the
+// user of the API token in it. Safe requests need the read scope and others
+// the vote scope. Requests without the header use the session.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bearer, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		token, err := s.storeFor(r).AuthenticateAPIToken(bearer)
+		if err != nil {
+			writeError(w, err.(ServerError))
+			return
+		}
+
+		scope := routeScope(r)
+		if !token.HasScope(scope) {
+			writeError(w, NewServerError(http.StatusForbidden,
+				fmt.Sprintf("API token needs the %s scope", scope)))
+			return
+		}
+
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			info.userID = token.UserID
+		}
+		ctx := context.WithValue(r.Context(), apiTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiToken returns the API token added to ctx by authenticate, or nil if the
+// request didn't use one.
+func apiToken(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenKey).(*APIToken)
+	return token
+}
+
+// accountRoutes are the API routes that manage users and groups, by method and
+// path below the API prefix. Passwords, sessions, API tokens and data exports
+// can't be managed with API tokens at all.
+var accountRoutes = map[string]bool{
+	"PUT /user/{id}":    true,
+	"DELETE /user/{id}": true,
+	"POST /group":       true,
+	"PUT /group/{gid}":  true,
+	"POST /group/join":  true,
+}
+
+// routeScope returns the scope an API token needs for the request's route:
+// account for accountRoutes, read for other safe methods and vote otherwise.
+func routeScope(r *http.Request) TokenScope {
+	route := routeName(r)
+	if path, ok := strings.CutPrefix(route, apiV1); ok {
+		route = path
+	} else {
+		route = strings.TrimPrefix(route, "/api")
+	}
+
+	switch {
+	case accountRoutes[r.Method+" "+route]:
+		return ScopeAccount
+	case safeMethod(r.Method):
+		return ScopeRead
+	default:
+		return ScopeVote
+	}
+}
+
+// safeMethod reports whether requests with the given method don't change
+// anything.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testClientID = "songvote"
+
+// mockOIDCProvider is a minimal OpenID Connect provider that logs in whoever
+// is set as its user without asking.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	subject  string
+	username string
+	codes    map[string]mockAuthRequest
+}
+
+// mockAuthRequest is what the mock provider remembers about an authorization
+// request until its code is exchanged.
+type mockAuthRequest struct {
+	nonce, challenge, subject, username string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	p := &mockOIDCProvider{key: key, codes: map[string]mockAuthRequest{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		p.mu.Lock()
+		code := p.nextCode()
+		p.codes[code] = mockAuthRequest{q.Get("nonce"), q.Get("code_challenge"), p.subject, p.username}
+		p.mu.Unlock()
+
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+q.Get("state"),
+			http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		req, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != req.challenge {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, "RS256", map[string]any{
+			"iss":                p.URL,
+			"sub":                req.subject,
+			"aud":                testClientID,
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"nonce":              req.nonce,
+			"preferred_username": req.username,
+		})})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// nextCode returns a new authorization code.
+func (p *mockOIDCProvider) nextCode() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setUser sets who the provider logs in.
+func (p *mockOIDCProvider) setUser(subject, username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subject, p.username = subject, username
+}
+
+// sign returns a JWT with the given claims signed with the provider's key.
+func (p *mockOIDCProvider) sign(t *testing.T, alg string, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": "test", "typ": "JWT"})
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	assert.NoError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+	oidc := newOIDCProvider(OIDCConfig{Issuer: provider.URL, ClientID: testClientID})
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   provider.URL,
+			"sub":   "123",
+			"aud":   []string{"other", testClientID},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "nonce",
+			"email": "john@example.com",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	t.Run("accepts valid token", func(t *testing.T) {
+		c, err := oidc.verify(context.Background(), provider.sign(t, "RS256", claims(nil)), "nonce")
+		assert.NoError(t, err)
+		assert.Equal(t, "123", c.Subject)
+		assert.Equal(t, "john@example.com", c.username())
+	})
+
+	t.Run("rejects invalid tokens", func(t *testing.T) {
+		tokens := map[string]string{
+			"wrong issuer":   provider.sign(t, "RS256", claims(map[string]any{"iss": "https://evil.example.com"})),
+			"wrong audience": provider.sign(t, "RS256", claims(map[string]any{"aud": "other"})),
+			"expired":        provider.sign(t, "RS256", claims(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})),
+			"wrong nonce":    provider.sign(t, "RS256", claims(map[string]any{"nonce": "replayed"})),
+			"no subject":     provider.sign(t, "RS256", claims(map[string]any{"sub": ""})),
+			"wrong alg":      provider.sign(t, "none", claims(nil)),
+			"malformed":      "not.a.token",
+		}
+
+		// Change the payload after signing.
+		valid := strings.Split(provider.sign(t, "RS256", claims(nil)), ".")
+		payload, _ := json.Marshal(claims(map[string]any{"sub": "admin"}))
+		valid[1] = base64.RawURLEncoding.EncodeToString(payload)
+		tokens["tampered"] = strings.Join(valid, ".")
+
+		for name, token := range tokens {
+			_, err := oidc.verify(context.Background(), token, "nonce")
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+
+	store, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	_, err = store.CreateUser(NewUserRequest{"John Doe", "password"})
+	assert.NoError(t, err)
+
+	server := NewServer(":0", store)
+	ts := httptest.NewUnstartedServer(nil)
+	server.EnableOIDC(OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://" + ts.Listener.Addr().String() + "/api/oidc/callback",
+	})
+	ts.Config.Handler = server.routes()
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	// loginWithOIDC goes through the login flow as the provider's user, checks
+	// the client is logged in and returns the ID of the user linked to the
+	// identity.
+	loginWithOIDC := func(t *testing.T, client *http.Client) int64 {
+		resp, err := client.Get(ts.URL + "/api/oidc/login")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, ts.URL+"/", resp.Request.URL.String())
+
+		resp, err = client.Get(ts.URL + "/api/token")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		user, err := store.GetUserByIdentity(provider.URL, provider.subject)
+		assert.NoError(t, err)
+		return user.ID
+	}
+
+	t.Run("provisions user on first login", func(t *testing.T) {
+		provider.setUser("jd-123", "John Doe")
+		id := loginWithOIDC(t, newTestClient(t))
+		assert.NotZero(t, id)
+
+		user, err := store.GetUserByID(id)
+		assert.NoError(t, err)
+		assert.Equal(t, "John Doe 2", user.Name)
+
+		log, err := store.GetAuditLog(AuditFilter{Action: AuditUserCreate})
+		assert.NoError(t, err)
+		assert.Len(t, log, 1)
+		assert.Equal(t, id, log[0].ActorID)
+		assert.Equal(t, id, log[0].TargetID)
+		assert.NotEmpty(t, log[0].RequestID)
+		assert.Contains(t, string(log[0].After), `"name":"John Doe 2"`)
+		assert.NotContains(t, string(log[0].After), "password")
+	})
+
+	t.Run("logs in the same user again", func(t *testing.T) {
+		users, err := store.GetUsers(defaultGroupID, TimeRange{})
+		assert.NoError(t, err)
+
+		loginWithOIDC(t, newTestClient(t))
+
+		after, err := store.GetUsers(defaultGroupID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, after, len(users))
+	})
+
+	t.Run("links identity to the logged in user", func(t *testing.T) {
+		client := newTestClient(t)
+		token := getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, token, ""))
+
+		provider.setUser("john", "jdoe")
+		assert.Equal(t, int64(1), loginWithOIDC(t, client))
+	})
+
+	// callbackStatus goes through the login flow as the provider's user and
+	// returns the status of the callback.
+	callbackStatus := func(t *testing.T) int {
+		resp, err := newTestClient(t).Get(ts.URL + "/api/oidc/login")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// countUsers returns the number of users, including inactive ones.
+	countUsers := func(t *testing.T) int {
+		var count int
+		assert.NoError(t, store.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count))
+		return count
+	}
+
+	t.Run("provisions users only while signup is open", func(t *testing.T) {
+		users := countUsers(t)
+		provider.setUser("jim", "Jim Doe")
+
+		for _, mode := range []SignupMode{SignupDisabled, SignupInvite} {
+			assert.NoError(t, store.SetSignupMode(mode))
+			assert.Equal(t, http.StatusForbidden, callbackStatus(t), mode)
+		}
+		assert.Equal(t, users, countUsers(t))
+
+		assert.NoError(t, store.SetSignupMode(SignupOpen))
+		assert.Equal(t, http.StatusOK, callbackStatus(t))
+	})
+
+	t.Run("rejects identities of inactive users", func(t *testing.T) {
+		provider.setUser("jd-123", "John Doe")
+		user, err := store.GetUserByIdentity(provider.URL, provider.subject)
+		assert.NoError(t, err)
+		assert.NoError(t, store.DeleteUser(user.ID))
+		users := countUsers(t)
+
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, http.StatusForbidden, callbackStatus(t))
+		}
+		assert.Equal(t, users, countUsers(t))
+	})
+
+	t.Run("rejects callbacks with the wrong state", func(t *testing.T) {
+		client := newTestClient(t)
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		resp, err := client.Get(ts.URL + "/api/oidc/login")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+		resp, err = client.Get(ts.URL + "/api/oidc/callback?code=abc&state=forged")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
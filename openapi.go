@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// apiV1 is the path prefix of version 1 of the API.
+const apiV1 = "/api/v1"
+
+// openAPISpec is the OpenAPI 3 document describing version 1 of the API.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// getOpenAPISpec returns the OpenAPI document of the API.
+func (s *Server) getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
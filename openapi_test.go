@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadOpenAPISpec returns the OpenAPI document of the API.
+func loadOpenAPISpec(t *testing.T) *openapi3.T {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	assert.NoError(t, err)
+	return doc
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	doc := loadOpenAPISpec(t)
+
+	t.Run("is a valid OpenAPI document", func(t *testing.T) {
+		assert.NoError(t, doc.Validate(context.Background()))
+	})
+
+	t.Run("documents every route", func(t *testing.T) {
+		store, err := NewStore(":memory:")
+		assert.NoError(t, err)
+
+		routes := map[string]bool{}
+		err = NewServer(":0", store).router().Walk(
+			func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+				template, err := route.GetPathTemplate()
+				if err != nil || !strings.HasPrefix(template, apiV1+"/") {
+					return nil
+				}
+				methods, err := route.GetMethods()
+				if err != nil {
+					return nil
+				}
+				path := strings.TrimPrefix(routeVarPattern.ReplaceAllString(template, "}"), apiV1)
+				for _, method := range methods {
+					routes[method+" "+path] = true
+				}
+				return nil
+			})
+		assert.NoError(t, err)
+
+		documented := map[string]bool{}
+		for path, item := range doc.Paths {
+			for method := range item.Operations() {
+				documented[method+" "+path] = true
+			}
+		}
+		assert.Equal(t, routes, documented)
+	})
+
+	t.Run("is served with the API", func(t *testing.T) {
+		ts, _ := newTestServer(t)
+		resp, err := http.Get(ts.URL + apiV1 + "/openapi.json")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, openAPISpec, body)
+	})
+}
+
+// contractClient makes API requests with a session and checks that each
+// response matches the OpenAPI document.
+type contractClient struct {
+	ts     *httptest.Server
+	doc    *openapi3.T
+	client *http.Client
+	csrf   string
+	called map[string]bool // IDs of the operations requested, shared by clients
+}
+
+func newContractClient(t *testing.T, ts *httptest.Server, doc *openapi3.T,
+	called map[string]bool) *contractClient {
+	c := &contractClient{ts: ts, doc: doc, client: newTestClient(t), called: called}
+	c.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	token := map[string]string{}
+	c.call(t, http.MethodGet, "/csrf", nil, http.StatusOK, &token)
+	c.csrf = token["token"]
+	return c
+}
+
+// call requests path under /api/v1 with body sent as a form if it is
+// url.Values or as JSON otherwise. It checks the status and that the response
+// matches the document, and decodes the response into out if it isn't nil.
+func (c *contractClient) call(t *testing.T, method, path string, body any, status int, out any) {
+	t.Helper()
+
+	var reader io.Reader
+	contentType := ""
+	switch body := body.(type) {
+	case nil:
+	case url.Values:
+		reader = strings.NewReader(body.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	default:
+		data, err := json.Marshal(body)
+		assert.NoError(t, err)
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequest(method, c.ts.URL+apiV1+path, reader)
+	assert.NoError(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("X-CSRF-Token", c.csrf)
+
+	resp, err := c.client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, status, resp.StatusCode, "%s %s: %s", method, path, data)
+
+	route, params := c.findRoute(t, method, path)
+	if route == nil {
+		return
+	}
+	c.called[route.Operation.OperationID] = true
+
+	err = openapi3filter.ValidateResponse(context.Background(),
+		&openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    req,
+				PathParams: params,
+				Route:      route,
+			},
+			Status:  resp.StatusCode,
+			Header:  resp.Header,
+			Body:    io.NopCloser(bytes.NewReader(data)),
+			Options: &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+	assert.NoError(t, err, "%s %s: %s", method, path, data)
+
+	if out != nil {
+		assert.NoError(t, json.Unmarshal(data, out))
+	}
+}
+
+// findRoute returns the documented operation of a request, preferring paths
+// with fewer parameters, and the values of its path parameters.
+func (c *contractClient) findRoute(t *testing.T, method, path string) (*routers.Route, map[string]string) {
+	path, _, _ = strings.Cut(path, "?")
+	segments := strings.Split(path, "/")
+
+	var found *routers.Route
+	var foundParams map[string]string
+	for template, item := range c.doc.Paths {
+		operation := item.GetOperation(method)
+		templateSegments := strings.Split(template, "/")
+		if operation == nil || len(templateSegments) != len(segments) {
+			continue
+		}
+
+		params := map[string]string{}
+		for i, segment := range templateSegments {
+			if name, ok := strings.CutPrefix(segment, "{"); ok {
+				params[strings.TrimSuffix(name, "}")] = segments[i]
+			} else if segment != segments[i] {
+				params = nil
+				break
+			}
+		}
+		if params == nil {
+			continue
+		}
+
+		if found == nil || len(params) < len(foundParams) {
+			found = &routers.Route{Spec: c.doc, Path: template, PathItem: item, Method: method,
+				Operation: operation}
+			foundParams = params
+		}
+	}
+
+	assert.NotNil(t, found, "%s %s isn't documented", method, path)
+	return found, foundParams
+}
+
+func TestAPIContract(t *testing.T) {
+	doc := loadOpenAPISpec(t)
+	ts, store := newTestServer(t)
+	called := map[string]bool{}
+
+	// Jane signs up; John, the admin, logs in.
+	jane := newContractClient(t, ts, doc, called)
+	jane.call(t, http.MethodGet, "/signup", nil, http.StatusOK, nil)
+	jane.call(t, http.MethodPost, "/user",
+		url.Values{"username": {"Jane Doe"}, "password": {"password"}}, http.StatusCreated, nil)
+
+	admin := newContractClient(t, ts, doc, called)
+	admin.call(t, http.MethodPost, "/login",
+		url.Values{"username": {"John Doe"}, "password": {"password"}}, http.StatusNoContent, nil)
+
+	t.Run("users", func(t *testing.T) {
+		admin.call(t, http.MethodGet, "/me", nil, http.StatusOK, nil)
+		admin.call(t, http.MethodGet, "/user/1", nil, http.StatusOK, nil)
+		admin.call(t, http.MethodGet, "/user/9", nil, http.StatusNotFound, nil)
+		admin.call(t, http.MethodPut, "/user/2", map[string]any{"name": "Jane Roe", "vetoes": 1},
+			http.StatusOK, nil)
+		admin.call(t, http.MethodGet, "/user/2/export", nil, http.StatusOK, nil)
+		admin.call(t, http.MethodGet, "/me/export", nil, http.StatusOK, nil)
+	})
+
+	t.Run("signup", func(t *testing.T) {
+		admin.call(t, http.MethodPut, "/signup", SignupSettings{Mode: SignupInvite},
+			http.StatusOK, nil)
+		admin.call(t, http.MethodPost, "/invite", InviteRequest{SingleUse: true},
+			http.StatusCreated, nil)
+		admin.call(t, http.MethodGet, "/invite", nil, http.StatusOK, nil)
+	})
+
+	t.Run("API tokens", func(t *testing.T) {
+		token := APIToken{}
+		admin.call(t, http.MethodPost, "/token",
+			APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeRead}}, http.StatusCreated, &token)
+		admin.call(t, http.MethodGet, "/token", nil, http.StatusOK, nil)
+		admin.call(t, http.MethodDelete, fmt.Sprintf("/token/%d", token.ID), nil,
+			http.StatusNoContent, nil)
+	})
+
+	group := Group{}
+	t.Run("groups", func(t *testing.T) {
+		admin.call(t, http.MethodPost, "/group", GroupRequest{Name: "Band"}, http.StatusCreated, &group)
+		admin.call(t, http.MethodGet, "/group", nil, http.StatusOK, nil)
+		admin.call(t, http.MethodGet, fmt.Sprintf("/group/%d", group.ID), nil, http.StatusOK, nil)
+		admin.call(t, http.MethodPut, fmt.Sprintf("/group/%d", group.ID), GroupRequest{SongQuota: 4},
+			http.StatusOK, nil)
+		jane.call(t, http.MethodPost, "/group/join", JoinGroupRequest{InviteCode: group.InviteCode},
+			http.StatusCreated, nil)
+		admin.call(t, http.MethodGet, fmt.Sprintf("/group/%d/members", group.ID), nil,
+			http.StatusOK, nil)
+	})
+
+	for _, prefix := range []string{"", fmt.Sprintf("/group/%d", group.ID)} {
+		t.Run("voting in "+prefix, func(t *testing.T) {
+			song, other := Song{}, Song{}
+			admin.call(t, http.MethodPost, prefix+"/song", map[string]string{
+				"title": "Song", "artist": "Artist"}, http.StatusCreated, &song)
+			admin.call(t, http.MethodPost, prefix+"/song", map[string]string{
+				"title": "Other", "artist": "Artist", "link_url": "https://example.com"},
+				http.StatusCreated, &other)
+			admin.call(t, http.MethodGet, prefix+"/song?since=2000-01-01T00:00:00Z", nil,
+				http.StatusOK, nil)
+
+			songPath := fmt.Sprintf("%s/song/%d", prefix, song.ID)
+			jane.call(t, http.MethodPost, songPath+"/vote", nil, http.StatusCreated, nil)
+			jane.call(t, http.MethodDelete, songPath+"/vote", nil, http.StatusNoContent, nil)
+			jane.call(t, http.MethodPost, songPath+"/veto", nil, http.StatusCreated, nil)
+			admin.call(t, http.MethodPost, songPath+"/override", nil, http.StatusOK, nil)
+
+			round := Round{}
+			admin.call(t, http.MethodGet, prefix+"/round", nil, http.StatusOK, &round)
+			admin.call(t, http.MethodPut, prefix+"/round", RoundRequest{VotingMethod: MethodRanked},
+				http.StatusOK, nil)
+			admin.call(t, http.MethodPut, prefix+"/ballot", BallotRequest{Choices: []int64{other.ID}},
+				http.StatusOK, nil)
+			admin.call(t, http.MethodGet, fmt.Sprintf("%s/round/%d/tally", prefix, round.ID), nil,
+				http.StatusOK, nil)
+			admin.call(t, http.MethodPost, prefix+"/round", nil, http.StatusCreated, nil)
+			admin.call(t, http.MethodGet, prefix+"/analytics", nil, http.StatusOK, nil)
+			admin.call(t, http.MethodGet, prefix+"/user", nil, http.StatusOK, nil)
+			admin.call(t, http.MethodGet, prefix+"/user/2/profile", nil, http.StatusOK, nil)
+		})
+	}
+
+	t.Run("audit log", func(t *testing.T) {
+		admin.call(t, http.MethodGet, "/audit?action=vote.create&limit=10", nil, http.StatusOK, nil)
+	})
+
+	t.Run("passwords", func(t *testing.T) {
+		reset := PasswordReset{}
+		admin.call(t, http.MethodPost, "/user/2/password-reset", nil, http.StatusCreated, &reset)
+		anonymous := newContractClient(t, ts, doc, called)
+		anonymous.call(t, http.MethodPost, "/password/reset",
+			ResetPasswordRequest{Token: reset.Token, NewPassword: "secret"}, http.StatusNoContent, nil)
+		admin.call(t, http.MethodPut, "/password",
+			ChangePasswordRequest{CurrentPassword: "password", NewPassword: "secret"},
+			http.StatusNoContent, nil)
+	})
+
+	t.Run("single sign-on", func(t *testing.T) {
+		admin.call(t, http.MethodGet, "/oidc/login", nil, http.StatusNotFound, nil)
+		admin.call(t, http.MethodGet, "/oidc/callback", nil, http.StatusNotFound, nil)
+	})
+
+	t.Run("deleting users", func(t *testing.T) {
+		id, err := store.CreateUser(NewUserRequest{"Max Doe", "password"})
+		assert.NoError(t, err)
+		admin.call(t, http.MethodDelete, fmt.Sprintf("/user/%d", id), nil, http.StatusNoContent, nil)
+		admin.call(t, http.MethodPost, "/user/2/erase", nil, http.StatusNoContent, nil)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		other := newContractClient(t, ts, doc, called)
+		other.call(t, http.MethodPost, "/login",
+			url.Values{"username": {"John Doe"}, "password": {"secret"}}, http.StatusNoContent, nil)
+
+		sessions := []Session{}
+		admin.call(t, http.MethodGet, "/me/sessions", nil, http.StatusOK, &sessions)
+		assert.Len(t, sessions, 2)
+		for _, session := range sessions {
+			if !session.Current {
+				admin.call(t, http.MethodDelete, fmt.Sprintf("/me/sessions/%d", session.ID), nil,
+					http.StatusNoContent, nil)
+			}
+		}
+		admin.call(t, http.MethodDelete, "/me/sessions", nil, http.StatusNoContent, nil)
+		other.call(t, http.MethodPost, "/logout", nil, http.StatusNoContent, nil)
+		admin.call(t, http.MethodGet, "/me", nil, http.StatusUnauthorized, nil)
+	})
+
+	t.Run("the document", func(t *testing.T) {
+		admin.call(t, http.MethodGet, "/openapi.json", nil, http.StatusOK, nil)
+	})
+
+	t.Run("requests every operation", func(t *testing.T) {
+		for _, item := range doc.Paths {
+			for _, operation := range item.Operations() {
+				assert.True(t, called[operation.OperationID], operation.OperationID)
+			}
+		}
+	})
+}
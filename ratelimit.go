@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Burst requests at once, refilled at PerMinute requests per
+// minute. A zero limit allows all requests.
+type RateLimit struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// RateLimitConfig sets how many requests each client may make. Clients are
+// users if they are logged in, or IP addresses if not.
+type RateLimitConfig struct {
+	Default    RateLimit            `json:"default"`     // limit of routes not in Routes
+	Routes     map[string]RateLimit `json:"routes"`      // by method and route, such as "POST /api/user"
+	MaxClients int                  `json:"max_clients"` // clients tracked, least recently seen dropped first
+}
+
+// DefaultRateLimitConfig returns the rate limits used unless configured
+// otherwise. Signing up, logging in and voting are limited more than other
+// routes.
+func DefaultRateLimitConfig() RateLimitConfig {
+	config := RateLimitConfig{
+		Default:    RateLimit{PerMinute: 600, Burst: 100},
+		Routes:     map[string]RateLimit{},
+		MaxClients: 10000,
+	}
+
+	votes := RateLimit{PerMinute: 60, Burst: 30}
+	for _, api := range []string{"/api", apiV1} {
+		config.Routes["POST "+api+"/user"] = RateLimit{PerMinute: 5, Burst: 10}
+		config.Routes["POST "+api+"/login"] = RateLimit{PerMinute: 10, Burst: 10}
+
+		for _, prefix := range []string{api, api + "/group/{gid}"} {
+			config.Routes["POST "+prefix+"/song"] = votes
+			config.Routes["POST "+prefix+"/song/{id}/vote"] = votes
+			config.Routes["DELETE "+prefix+"/song/{id}/vote"] = votes
+			config.Routes["POST "+prefix+"/song/{id}/veto"] = votes
+			config.Routes["POST "+prefix+"/song/{id}/override"] = votes
+			config.Routes["PUT "+prefix+"/ballot"] = votes
+		}
+	}
+
+	return config
+}
+
+// ParseRateLimitConfig reads rate limits from JSON, overriding the defaults
+// it sets. The limits of routes not in the JSON keep their default.
+func ParseRateLimitConfig(data string) (RateLimitConfig, error) {
+	config := DefaultRateLimitConfig()
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return config, fmt.Errorf("error parsing rate limits: %v", err)
+	}
+	return config, nil
+}
+
+// SetRateLimits replaces the rate limits of the server.
+func (s *Server) SetRateLimits(config RateLimitConfig) {
+	s.limiter = newRateLimiter(config)
+}
+
+// limitRate rejects requests with 429 Too Many Requests once their client
+// has used up the rate limit of the route. Responses say how many requests
+// are left in RateLimit-* headers.
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + routeName(r)
+		limit, ok := s.limiter.config.Routes[route]
+		if !ok {
+			route, limit = "default", s.limiter.config.Default
+		}
+		if limit.PerMinute <= 0 || limit.Burst <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := "ip " + remoteIP(r)
+		if userID, ok := s.authUserID(r); ok {
+			client = fmt.Sprintf("user %d", userID)
+		}
+
+		result := s.limiter.take(route+" "+client, limit)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.reset)))
+		if !result.allowed {
+			logger(r.Context()).Warn("Rate limit exceeded", "route", route, "client", client)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(result.retryAfter)))
+			writeError(w, ErrTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds returns d in whole seconds, rounded up.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimiter keeps a token bucket for each client of each rate limited
+// route. Buckets of the least recently seen clients are dropped once there
+// are more than MaxClients, which only forgets requests of clients that have
+// been quiet longest.
+type rateLimiter struct {
+	config  RateLimitConfig
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*list.Element // by route and client
+	recent  *list.List               // of *bucket, most recently used first
+}
+
+// bucket holds the requests a client may still make, refilled over time.
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// rateResult is the outcome of taking a request from a bucket.
+type rateResult struct {
+	allowed    bool
+	remaining  int           // requests left
+	reset      time.Duration // time until the bucket is full again
+	retryAfter time.Duration // time until the next request is allowed
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.MaxClients <= 0 {
+		config.MaxClients = DefaultRateLimitConfig().MaxClients
+	}
+	return &rateLimiter{
+		config:  config,
+		now:     time.Now,
+		buckets: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+// take takes a request from the bucket with the given key, if it has one
+// left, filling the bucket first for the time since it was last used.
+func (l *rateLimiter) take(key string, limit RateLimit) rateResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	perSecond := limit.PerMinute / 60
+	burst := float64(limit.Burst)
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = min(burst, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+		b.updated = now
+	} else {
+		if l.recent.Len() >= l.config.MaxClients {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: burst, updated: now}
+		l.buckets[key] = l.recent.PushFront(b)
+	}
+
+	result := rateResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	result.remaining = int(b.tokens)
+	result.reset = time.Duration((burst - b.tokens) / perSecond * float64(time.Second))
+	return result
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CookieConfig configures the session cookie.
+type CookieConfig struct {
+	Name   string // cookie name, "session" if empty
+	Domain string // domain the cookie is sent to, only the server's host if empty
+	Secure bool   // send the cookie over HTTPS only
+}
+
+// ConfigureCookie sets the name, domain and Secure flag of the session cookie.
+func (s *Server) ConfigureCookie(config CookieConfig) {
+	if config.Name != "" {
+		s.sessionManager.Cookie.Name = config.Name
+	}
+	s.sessionManager.Cookie.Domain = config.Domain
+	s.sessionManager.Cookie.Secure = config.Secure
+}
+
+// hstsMaxAge is how long browsers keep using HTTPS once told to, in seconds.
+const hstsMaxAge = 2 * 365 * 24 * 60 * 60
+
+// secureHeaders sets headers that stop browsers from sniffing content types,
+// framing pages, leaking URLs to other sites and running scripts not served
+// by the app. Templates load htmx and their styles from /static, and their
+// scripts are allowed by the nonce of the request's Content-Security-Policy.
+// Requests made over TLS, directly or through a proxy, are also told to keep
+// using HTTPS.
+func (s *Server) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := randomToken()
+		if err != nil {
+			writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy(nonce))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			h.Set("Strict-Transport-Security",
+				fmt.Sprintf("max-age=%d; includeSubDomains", hstsMaxAge))
+		}
+
+		ctx := context.WithValue(r.Context(), cspNonceKey, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// contentSecurityPolicy returns the policy of a response whose scripts carry
+// the given nonce. Styles may be inline, as htmx adds them to the page.
+func contentSecurityPolicy(nonce string) string {
+	return strings.Join([]string{
+		"default-src 'self'",
+		fmt.Sprintf("script-src 'nonce-%s'", nonce),
+		"style-src 'self' 'unsafe-inline'",
+		"img-src 'self' data:",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}, "; ")
+}
+
+// cspNonce returns the nonce that secureHeaders allows scripts with.
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceKey).(string)
+	return nonce
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -19,51 +22,164 @@ type Server struct {
 	port           string              // port number
 	store          *Store              // data storage
 	sessionManager *scs.SessionManager // session manager
+	oidc           *oidcProvider       // single sign-on provider, nil if disabled
+	limiter        *rateLimiter        // rate limits of clients
+	tls            *TLSConfig          // HTTPS settings, nil to serve HTTP
 }
 
 // NewServer creates and configures a new server.
 func NewServer(port string, store *Store) *Server {
 	sessionManager := scs.New()
-	sessionManager.Store = sqlite3store.New(store.db)
-	sessionManager.Lifetime = 24 * time.Hour
+	sessionManager.Store = sqlite3store.New(store.db.DB)
+	sessionManager.Lifetime = sessionLifetime
 	sessionManager.Cookie.SameSite = http.SameSiteLaxMode
 
 	return &Server{
 		port:           port,
 		store:          store,
 		sessionManager: sessionManager,
+		limiter:        newRateLimiter(DefaultRateLimitConfig()),
 	}
 }
 
-// ListenAndServe starts the web server.
+// EnableOIDC lets users log in with an OpenID Connect provider.
+func (s *Server) EnableOIDC(config OIDCConfig) {
+	s.oidc = newOIDCProvider(config)
+}
+
+// ListenAndServe starts the web server, over HTTPS if TLS is enabled. The
+// certificate is then also reloaded on SIGHUP.
 func (s *Server) ListenAndServe() error {
+	if s.tls != nil {
+		return s.listenAndServeTLS()
+	}
+
+	slog.Info("Server listening", "port", s.port)
+	return http.ListenAndServe(s.port, s.routes())
+}
+
+// routes returns the handler for all routes.
+func (s *Server) routes() http.Handler {
+	// Metrics, health checks and static files are served without sessions.
+	root := http.NewServeMux()
+	root.HandleFunc("/metrics", s.metricsHandler)
+	root.HandleFunc("/healthz", s.healthz)
+	root.HandleFunc("/readyz", s.readyz)
+	root.Handle("/static/", staticHandler())
+	root.Handle("/", s.sessionManager.LoadAndSave(s.router()))
+
+	return s.secureHeaders(root)
+}
+
+// router returns the router of the template and API routes with their
+// middleware. The API is served under /api/v1, and under /api for clients
+// made before it was versioned.
+func (s *Server) router() *mux.Router {
 	router := mux.NewRouter()
 
 	// Template routes
-	router.Handle("/", templ.Handler(index())).Methods(http.MethodGet)
+	router.Handle("/", templ.Handler(index(s.oidc != nil))).Methods(http.MethodGet)
+	router.HandleFunc("/user/{id}", s.userProfilePage).Methods(http.MethodGet)
+	router.HandleFunc("/analytics", s.analyticsPage).Methods(http.MethodGet)
 
 	// API routes
-	router.HandleFunc("/api/user", s.createUser).Methods(http.MethodPost)
-	router.HandleFunc("/api/user", s.getUsers).Methods(http.MethodGet)
-	router.HandleFunc("/api/user/{id}", s.getUser).Methods(http.MethodGet)
-	router.HandleFunc("/api/user/{id}", s.deleteUser).Methods(http.MethodDelete)
-	router.HandleFunc("/api/user/{id}", s.updateUser).Methods(http.MethodPut)
-	router.HandleFunc("/api/login", s.loginUser).Methods(http.MethodPost)
-	router.HandleFunc("/api/logout", s.logoutUser).Methods(http.MethodGet)
+	router.HandleFunc(apiV1+"/openapi.json", s.getOpenAPISpec).Methods(http.MethodGet)
+	s.handleAPIRoutes(router, apiV1)
+	s.handleAPIRoutes(router, "/api")
 
 	// Middleware
-	router.Use(logRequests)
+	router.Use(s.logRequests)
+	router.Use(s.authenticate)
+	router.Use(s.checkSession)
+	router.Use(s.limitRate)
+	router.Use(s.csrfProtect)
+
+	return router
+}
+
+// handleAPIRoutes registers the API routes under prefix.
+func (s *Server) handleAPIRoutes(router *mux.Router, prefix string) {
+	router.HandleFunc(prefix+"/user", s.createUser).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/user/{id}", s.getUser).Methods(http.MethodGet)
+	router.Handle(prefix+"/user/{id}", s.requireSelfOrAdmin(s.deleteUser)).
+		Methods(http.MethodDelete)
+	router.Handle(prefix+"/user/{id}", s.requireSelfOrAdmin(s.updateUser)).
+		Methods(http.MethodPut)
+	router.Handle(prefix+"/user/{id}/password-reset", s.requireAdmin(s.createPasswordReset)).
+		Methods(http.MethodPost)
+	router.Handle(prefix+"/user/{id}/export", s.requireAdmin(s.exportUserData)).
+		Methods(http.MethodGet)
+	router.Handle(prefix+"/user/{id}/erase", s.requireAdmin(s.eraseUser)).
+		Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/password", s.changePassword).Methods(http.MethodPut)
+	router.HandleFunc(prefix+"/me", s.getCurrentUser).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/me/export", s.exportOwnData).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/me/sessions", s.getSessions).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/me/sessions", s.revokeSessions).Methods(http.MethodDelete)
+	router.HandleFunc(prefix+"/me/sessions/{id}", s.revokeSession).Methods(http.MethodDelete)
+	router.HandleFunc(prefix+"/password/reset", s.resetPassword).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/csrf", s.getCSRFToken).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/login", s.loginUser).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/logout", s.logoutUser).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/oidc/login", s.oidcLogin).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/oidc/callback", s.oidcCallback).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/signup", s.getSignupSettings).Methods(http.MethodGet)
+	router.Handle(prefix+"/signup", s.requireAdmin(s.updateSignupSettings)).
+		Methods(http.MethodPut)
+	router.Handle(prefix+"/invite", s.requireAdmin(s.createInvite)).Methods(http.MethodPost)
+	router.Handle(prefix+"/invite", s.requireAdmin(s.getInvites)).Methods(http.MethodGet)
+	router.Handle(prefix+"/audit", s.requireAdmin(s.getAuditLog)).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/token", s.createAPIToken).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/token", s.getAPITokens).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/token/{id}", s.revokeAPIToken).Methods(http.MethodDelete)
+	router.HandleFunc(prefix+"/group", s.createGroup).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/group", s.getGroups).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/group/join", s.joinGroup).Methods(http.MethodPost)
+
+	// Group routes, for members of the group only
+	group := router.PathPrefix(prefix + "/group/{gid:[0-9]+}").Subrouter()
+	group.HandleFunc("", s.getGroup).Methods(http.MethodGet)
+	group.HandleFunc("", s.updateGroup).Methods(http.MethodPut)
+	group.HandleFunc("/members", s.getMembers).Methods(http.MethodGet)
+	s.handleGroupRoutes(group, "")
+	group.Use(s.requireMember)
+
+	// Group routes of the default group, for its members only
+	defaultGroup := router.PathPrefix(prefix).Subrouter()
+	s.handleGroupRoutes(defaultGroup, "")
+	defaultGroup.Use(s.requireMember)
+}
 
-	// Start the server
-	slog.Info("Server listening", "port", port)
-	return http.ListenAndServe(port, s.sessionManager.LoadAndSave(router))
+// handleGroupRoutes registers the routes scoped to a group under prefix.
+func (s *Server) handleGroupRoutes(router *mux.Router, prefix string) {
+	router.HandleFunc(prefix+"/user", s.getUsers).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/user/{id}/profile", s.getUserProfile).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/round", s.getCurrentRound).Methods(http.MethodGet)
+	router.Handle(prefix+"/round", s.requireGroupAdmin(s.startRound)).Methods(http.MethodPost)
+	router.Handle(prefix+"/round", s.requireGroupAdmin(s.updateRound)).Methods(http.MethodPut)
+	router.HandleFunc(prefix+"/round/{id}/tally", s.getTally).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/ballot", s.submitBallot).Methods(http.MethodPut)
+	router.HandleFunc(prefix+"/song", s.getSongs).Methods(http.MethodGet)
+	router.HandleFunc(prefix+"/song", s.createSong).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/song/{id}/vote", s.voteForSong).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/song/{id}/vote", s.retractVote).Methods(http.MethodDelete)
+	router.HandleFunc(prefix+"/song/{id}/veto", s.vetoSong).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/song/{id}/override", s.overrideVeto).Methods(http.MethodPost)
+	router.HandleFunc(prefix+"/analytics", s.getAnalytics).Methods(http.MethodGet)
 }
 
-// getUsers returns a list of all users with their ids.
+// getUsers returns a list of the users of a group with their ids.
 func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := s.store.GetUsers()
+	created, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	users, err := s.storeFor(r).GetUsers(groupID(r), created)
 	if err != nil {
 		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+		return
 	}
 
 	writeJSON(w, http.StatusOK, users)
@@ -73,35 +189,114 @@ func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
 func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+		writeError(w, ErrBadRequest)
+		return
 	}
 
-	user, err := s.store.GetUserByID(userID)
+	user, err := s.storeFor(r).GetUserByID(userID)
 	if err != nil {
 		writeError(w, ErrNotFound)
+		return
 	}
+	user.Password = ""
 
 	writeJSON(w, http.StatusOK, user)
 }
 
-// updateUser updates a user.
+// getCurrentUser returns the logged in user with their role and what they
+// have left to spend in each of their groups.
+func (s *Server) getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	me, err := s.storeFor(r).GetCurrentUser(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, me)
+}
+
+// getUserProfile returns the profile and activity statistics in a group of the
+// user with the given id.
+func (s *Server) getUserProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	profile, err := s.storeFor(r).GetUserProfile(groupID(r), userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// userProfilePage renders the profile page of the user with the given id.
+func (s *Server) userProfilePage(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, err := s.storeFor(r).GetUserProfile(defaultGroupID, userID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	templ.Handler(profile(p)).ServeHTTP(w, r)
+}
+
+// updateUser updates a user. Only admins can change the user's vetoes.
 func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	store := s.storeFor(r)
+
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+		writeError(w, ErrBadRequest)
+		return
 	}
 
-	user := &User{}
-	if err := json.NewDecoder(r.Body).Decode(user); err != nil {
-		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+	req := UpdateUserRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	before, err := store.GetUserByID(id)
+	if err != nil {
+		writeError(w, ErrNotFound)
+		return
 	}
-	user.ID = id
 
-	if err := s.store.UpdateUser(user); err != nil {
+	user := &User{ID: id, Name: req.Name, Password: req.Password, Inactive: req.Inactive,
+		Vetoes: before.Vetoes}
+	if req.Vetoes != nil && *req.Vetoes != before.Vetoes {
+		if !s.isAdmin(r) {
+			writeError(w, NewServerError(http.StatusForbidden, "only admins can change vetoes"))
+			return
+		}
+		user.Vetoes = *req.Vetoes
+	}
+
+	if err := store.UpdateUser(user); err != nil {
 		serverError := err.(ServerError)
 		writeError(w, serverError)
+		return
 	}
 
+	after, _ := store.GetUserByID(id)
+	s.audit(r, AuditUserUpdate, AuditTargetUser, id, auditUser(before), auditUser(after))
+
 	writeJSON(w, http.StatusOK, user)
 }
 
@@ -109,90 +304,501 @@ func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
 func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+		writeError(w, ErrBadRequest)
+		return
 	}
 
-	if err := s.store.DeleteUser(id); err != nil {
-		slog.Error("error deleting user", "id", id, "error", err.Error())
+	before, _ := s.storeFor(r).GetUserByID(id)
+	if err := s.storeFor(r).DeleteUser(id); err != nil {
+		logger(r.Context()).Error("error deleting user", "id", id, "error", err.Error())
 		writeError(w, ErrNotFound)
+		return
 	}
+	s.audit(r, AuditUserDelete, AuditTargetUser, id, auditUser(before), nil)
 
 	writeJSON(w, http.StatusNoContent, nil)
 }
 
-// logoutUser logs out the user by clearing session data.
+// logoutUser logs out the user by revoking the session and clearing session
+// data. It only takes POST requests, so it is covered by the CSRF check and
+// other sites can't log users out with a link.
 func (s *Server) logoutUser(w http.ResponseWriter, r *http.Request) {
 	username := s.sessionManager.Get(r.Context(), "username")
-	id := s.sessionManager.Get(r.Context(), "user_id")
+	id := s.sessionManager.GetInt64(r.Context(), "user_id")
+
+	sessionID := s.sessionManager.GetInt64(r.Context(), "session_id")
+	if sessionID != 0 {
+		if err := s.storeFor(r).RevokeSession(id, sessionID); err != nil {
+			logger(r.Context()).Error("error revoking session", "error", err)
+		}
+	}
 
 	if err := s.sessionManager.Clear(r.Context()); err != nil {
-		slog.Error(err.Error())
+		logger(r.Context()).Error(err.Error())
 	}
 
-	slog.Info("Logged out user", "user", username, "ID", id)
+	logger(r.Context()).Info("Logged out user", "user", username, "ID", id)
 
 	writeJSON(w, http.StatusNoContent, nil)
 }
 
-// loginUser processes requests to log in an existing user.
+// loginUser processes requests to log in an existing user. Unknown users,
+// inactive users and wrong passwords get the same response in about the same
+// time, and repeated failures make the user name and address wait before
+// trying again.
 func (s *Server) loginUser(w http.ResponseWriter, r *http.Request) {
+	store := s.storeFor(r)
+
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	ip := remoteIP(r)
 
-	user, err := s.store.GetUserByName(username)
+	wait, err := store.LoginRetryAfter(username, ip)
 	if err != nil {
-		writeError(w, ErrNotFound)
+		writeError(w, err.(ServerError))
 		return
 	}
-
-	if user.Inactive {
-		writeError(w, NewServerError(http.StatusUnauthorized, "user is inactive"))
+	if wait > 0 {
+		writeRetryAfter(w, wait)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
+	// Compare against a dummy hash if the user doesn't exist, so the response
+	// takes as long as for a wrong password.
+	hash := dummyPasswordHash
+	user, err := store.GetUserByName(username)
+	if err == nil {
+		hash = []byte(user.Password)
+	}
+
+	if comparePassword(r.Context(), hash, password) != nil || user == nil {
+		// Answer the same whether or not the failure could be recorded, so
+		// errors don't tell guesses apart.
+		if err := store.RecordLoginFailure(username, ip); err != nil {
+			logger(r.Context()).Error("error recording failed login", "error", err)
+		}
+		logger(r.Context()).Info("Failed login", "user", username, "ip", ip)
 		writeError(w, NewServerError(http.StatusUnauthorized,
 			"incorrect username and/or password"))
 		return
 	}
 
-	s.sessionManager.Put(r.Context(), "user_id", user.ID)
-	s.sessionManager.Put(r.Context(), "username", user.Name)
-	slog.Info("Logged in user", "user", user.Name, "ID", user.ID)
+	if err := store.ResetLoginFailures(username, ip); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	if err := s.startSession(r, user); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	logger(r.Context()).Info("Logged in user", "user", user.Name, "ID", user.ID)
 
 	writeJSON(w, http.StatusNoContent, nil)
 }
 
-// createUser processes requests to create a new user.
+// writeRetryAfter answers that too many logins failed, and how long to wait
+// before trying again.
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, ErrTooManyRequests)
+}
+
+// dummyPasswordHash is compared against when logging in as a user that doesn't
+// exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("songvote"), bcrypt.DefaultCost)
+
+// remoteIP returns the address of the client that sent the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// createUser processes requests to create a new user, redeeming the invite
+// token given in the "invite" form value, if any.
 func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
 	userReq := NewUserRequest{
 		Name:     r.FormValue("username"),
 		Password: r.FormValue("password"),
 	}
 
-	id, err := s.store.CreateUser(userReq)
+	id, err := s.storeFor(r).RegisterUser(userReq, r.FormValue("invite"))
 	if err != nil {
 		writeError(w, err.(ServerError))
 		return
 	}
 
-	s.sessionManager.Put(r.Context(), "user_id", id)
-	s.sessionManager.Put(r.Context(), "username", userReq.Name)
+	user, err := s.storeFor(r).GetUserByID(id)
+	if err != nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	if err := s.startSession(r, user); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditUserCreate, AuditTargetUser, id, nil, auditUser(user))
 
 	newUser := NewUserResponse{id, userReq.Name}
 
 	writeJSON(w, http.StatusCreated, newUser)
 }
 
+// getCurrentRound returns the open round of the group.
+func (s *Server) getCurrentRound(w http.ResponseWriter, r *http.Request) {
+	round, err := s.storeFor(r).GetCurrentRound(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, round)
+}
+
+// startRound closes the open round of the group and starts a new one.
+func (s *Server) startRound(w http.ResponseWriter, r *http.Request) {
+	store := s.storeFor(r)
+
+	before, err := store.GetCurrentRound(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	round, err := store.StartNewRound(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	if closed, err := store.GetRoundByID(before.ID); err == nil {
+		before = closed
+	}
+	s.audit(r, AuditRoundStart, AuditTargetRound, round.ID, before, round)
+
+	writeJSON(w, http.StatusCreated, round)
+}
+
+// updateRound changes the settings of the open round of the group.
+func (s *Server) updateRound(w http.ResponseWriter, r *http.Request) {
+	req := RoundRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	before, err := s.storeFor(r).GetCurrentRound(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	round, err := s.storeFor(r).UpdateRound(groupID(r), req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditRoundUpdate, AuditTargetRound, round.ID, before, round)
+
+	writeJSON(w, http.StatusOK, round)
+}
+
+// getTally counts the ballots of the round with the given id.
+func (s *Server) getTally(w http.ResponseWriter, r *http.Request) {
+	roundID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	round, err := s.storeFor(r).GetRoundByID(roundID)
+	if err != nil || round.GroupID != groupID(r) {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	result, err := s.storeFor(r).TallyRound(roundID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// submitBallot records the logged in user's ballot for the open round of the
+// group.
+func (s *Server) submitBallot(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	req := BallotRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+	req.UserID = userID
+	req.GroupID = groupID(r)
+
+	ballot, err := s.storeFor(r).SubmitBallot(req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	if round, err := s.storeFor(r).GetCurrentRound(req.GroupID); err == nil {
+		s.audit(r, AuditBallotSubmit, AuditTargetRound, round.ID, nil, ballot)
+	}
+
+	writeJSON(w, http.StatusOK, ballot)
+}
+
+// getSongs returns the songs of the group.
+func (s *Server) getSongs(w http.ResponseWriter, r *http.Request) {
+	created, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	songs, err := s.storeFor(r).GetSongs(groupID(r), created)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, songs)
+}
+
+// createSong adds a song to the group on behalf of the logged in user.
+func (s *Server) createSong(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	req := NewSongRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+	req.GroupID = groupID(r)
+	req.AddedBy = userID
+
+	id, err := s.storeFor(r).CreateSong(req)
+	if err != nil {
+		if serverError, ok := err.(ServerError); ok {
+			writeError(w, serverError)
+		} else {
+			writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		}
+		return
+	}
+
+	song, err := s.storeFor(r).GetSongByID(id)
+	if err != nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+	s.audit(r, AuditSongCreate, AuditTargetSong, id, nil, song)
+
+	writeJSON(w, http.StatusCreated, song)
+}
+
+// voteForSong records the logged in user's vote for the song with the given id.
+func (s *Server) voteForSong(w http.ResponseWriter, r *http.Request) {
+	songID, userID, ok := s.songAndUserIDs(w, r)
+	if !ok {
+		return
+	}
+	req := VoteRequest{SongID: songID, UserID: userID}
+
+	voteID, err := s.storeFor(r).VoteForSong(req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditVoteCreate, AuditTargetSong, songID, nil, Vote{
+		ID: voteID, SongID: songID, UserID: userID})
+
+	user, err := s.storeFor(r).GetUserByID(req.UserID)
+	if err != nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+	user.Password = ""
+
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// retractVote removes the logged in user's vote for the song with the given
+// id and refunds it.
+func (s *Server) retractVote(w http.ResponseWriter, r *http.Request) {
+	songID, userID, ok := s.songAndUserIDs(w, r)
+	if !ok {
+		return
+	}
+	req := VoteRequest{SongID: songID, UserID: userID}
+
+	if err := s.storeFor(r).RetractVote(req); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditVoteDelete, AuditTargetSong, songID, req, nil)
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// songAndUserIDs returns the song id in the path and the ID of the logged in
+// user. It writes an error response and returns false if either is missing or
+// the song is not in the group.
+func (s *Server) songAndUserIDs(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return 0, 0, false
+	}
+
+	songID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return 0, 0, false
+	}
+	setSpanAttributes(r.Context(), songIDKey.Int64(songID))
+
+	song, err := s.storeFor(r).GetSongByID(songID)
+	if err != nil || song.GroupID != groupID(r) {
+		writeError(w, ErrNotFound)
+		return 0, 0, false
+	}
+
+	return songID, userID, true
+}
+
+// overrideVeto records the logged in user's vote to lift the veto of the song
+// with the given id.
+func (s *Server) overrideVeto(w http.ResponseWriter, r *http.Request) {
+	songID, userID, ok := s.songAndUserIDs(w, r)
+	if !ok {
+		return
+	}
+
+	resp, err := s.storeFor(r).OverrideVeto(OverrideRequest{SongID: songID, UserID: userID})
+	if err != nil {
+		if serverError, ok := err.(ServerError); ok {
+			writeError(w, serverError)
+		} else {
+			writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		}
+		return
+	}
+	s.audit(r, AuditVetoOverride, AuditTargetSong, songID, nil, resp)
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// vetoSong records the logged in user's veto of the song with the given id.
+func (s *Server) vetoSong(w http.ResponseWriter, r *http.Request) {
+	songID, userID, ok := s.songAndUserIDs(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := s.storeFor(r).VetoSong(VetoRequest{SongID: songID, UserID: userID})
+	if err != nil {
+		if serverError, ok := err.(ServerError); ok {
+			writeError(w, serverError)
+		} else {
+			writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		}
+		return
+	}
+
+	veto := Veto{ID: id, SongID: songID, UserID: userID}
+	s.audit(r, AuditVetoCreate, AuditTargetSong, songID, nil, veto)
+
+	writeJSON(w, http.StatusCreated, veto)
+}
+
+// getAnalytics returns the group leaderboards and voting trends.
+func (s *Server) getAnalytics(w http.ResponseWriter, r *http.Request) {
+	a, err := s.storeFor(r).GetAnalytics(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a)
+}
+
+// analyticsPage renders the leaderboard and analytics dashboard of the
+// default group.
+func (s *Server) analyticsPage(w http.ResponseWriter, r *http.Request) {
+	a, err := s.storeFor(r).GetAnalytics(defaultGroupID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templ.Handler(analytics(a)).ServeHTTP(w, r)
+}
+
+// getCSRFToken returns the CSRF token of the session, for API clients to send
+// in the X-CSRF-Token header of state-changing requests.
+func (s *Server) getCSRFToken(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"token": csrfToken(r.Context())})
+}
+
+// authUserID returns the ID of the user the request was made by, from its API
+// token or its session, if any.
+func (s *Server) authUserID(r *http.Request) (int64, bool) {
+	if token := apiToken(r.Context()); token != nil {
+		return token.UserID, true
+	}
+
+	id := s.sessionManager.GetInt64(r.Context(), "user_id")
+	return id, id != 0
+}
+
+// parseTimeRange returns the time range given by the since and until query
+// parameters, in RFC 3339 format. Missing parameters leave the range open.
+func parseTimeRange(r *http.Request) (TimeRange, error) {
+	tr := TimeRange{}
+	bounds := map[string]*time.Time{"since": &tr.Since, "until": &tr.Until}
+	for key, bound := range bounds {
+		value := r.URL.Query().Get(key)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return tr, fmt.Errorf("invalid %s time %q", key, value)
+		}
+		*bound = t
+	}
+	return tr, nil
+}
+
 // writeJSON encodes v into a JSON object and writes it to the response writer
-// with the provided status code in the header.
+// with the provided status code in the header. A nil v writes no body, as for
+// 204 No Content responses.
 func writeJSON(w http.ResponseWriter, status int, v any) {
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
-	if v != nil {
-		if err := json.NewEncoder(w).Encode(v); err != nil {
-			writeError(w, err.(ServerError))
-		}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error encoding JSON", "error", err.Error())
 	}
 }
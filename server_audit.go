@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// audit records a state-changing action of the logged in user, if any.
+// before and after are snapshots of the target, or nil if it didn't exist.
+// The action has already happened, so errors are only logged.
+func (s *Server) audit(r *http.Request, action, targetType string, targetID int64,
+	before, after any) {
+	actorID, _ := s.authUserID(r)
+	entry := AuditEntry{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		RequestID:  requestID(r.Context()),
+	}
+
+	var err error
+	if entry.Before, err = snapshot(before); err == nil {
+		entry.After, err = snapshot(after)
+	}
+	if err != nil {
+		logger(r.Context()).Error("error encoding audit snapshot", "action", action, "error", err)
+	}
+
+	if err := s.storeFor(r).LogAudit(entry); err != nil {
+		logger(r.Context()).Error("error auditing action", "action", action, "error", err)
+	}
+}
+
+// snapshot encodes v as JSON for the audit log, or returns nil if v is nil.
+func snapshot(v any) (json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil, err
+	}
+	return b, nil
+}
+
+// auditUser returns a copy of a user to snapshot, without the password hash.
+func auditUser(user *User) *User {
+	if user == nil {
+		return nil
+	}
+	snapshot := *user
+	snapshot.Password = ""
+	return &snapshot
+}
+
+// getAuditLog returns the audit entries matching the query parameters actor,
+// action, target_type, target_id, since and until (RFC 3339), newest first
+// and at most limit of them.
+func (s *Server) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+	}
+
+	var err error
+	if filter.TimeRange, err = parseTimeRange(r); err != nil {
+		writeError(w, NewServerError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	ids := map[string]*int64{"actor": &filter.ActorID, "target_id": &filter.TargetID}
+	for key, dest := range ids {
+		if value := query.Get(key); value != "" {
+			if *dest, err = strconv.ParseInt(value, 10, 64); err != nil {
+				writeError(w, NewServerError(http.StatusBadRequest, "invalid "+key))
+				return
+			}
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			writeError(w, NewServerError(http.StatusBadRequest, "invalid limit"))
+			return
+		}
+	}
+
+	entries, err := s.storeFor(r).GetAuditLog(filter)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
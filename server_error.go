@@ -29,8 +29,14 @@ var (
 	ErrBadRequest = NewServerError(http.StatusBadRequest, "bad request")
 	// Unauthorized (401)
 	ErrUnauthorized = NewServerError(http.StatusUnauthorized, "unauthorized")
+	// Forbidden (403)
+	ErrForbidden = NewServerError(http.StatusForbidden, "forbidden")
 	// Not Found (404)
 	ErrNotFound = NewServerError(http.StatusNotFound, "resource not found")
+	// Forbidden (403) - missing or wrong CSRF token
+	ErrCSRF = NewServerError(http.StatusForbidden, "invalid CSRF token")
+	// Too Many Requests (429)
+	ErrTooManyRequests = NewServerError(http.StatusTooManyRequests, "too many requests")
 )
 
 func (e ServerError) Error() string {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// exportOwnData returns the logged in user's data as a JSON archive.
+func (s *Server) exportOwnData(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	s.writeExport(w, r, userID)
+}
+
+// exportUserData returns the data of the user with the given id as a JSON
+// archive.
+func (s *Server) exportUserData(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	s.writeExport(w, r, userID)
+}
+
+// writeExport writes the data of a user as a JSON file download.
+func (s *Server) writeExport(w http.ResponseWriter, r *http.Request, userID int64) {
+	export, err := s.storeFor(r).ExportUser(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="songvote-user-%d.json"`, userID))
+	writeJSON(w, http.StatusOK, export)
+}
+
+// eraseUser removes the personal data of the user with the given id.
+func (s *Server) eraseUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	if err := s.storeFor(r).EraseUser(userID); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditUserErase, AuditTargetUser, userID, nil, nil)
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
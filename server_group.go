@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// createGroup creates a new group owned by the logged in user.
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	req := GroupRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	group, err := s.storeFor(r).CreateGroup(userID, req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, group)
+}
+
+// getGroups returns the groups the logged in user is a member of.
+func (s *Server) getGroups(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	groups, err := s.storeFor(r).GetGroupsByUserID(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// joinGroup adds the logged in user to the group with the given invite code.
+func (s *Server) joinGroup(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	req := JoinGroupRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	member, err := s.storeFor(r).JoinGroup(userID, req.InviteCode)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, member)
+}
+
+// getGroup returns the group with the given id.
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := s.storeFor(r).GetGroupByID(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, group)
+}
+
+// updateGroup changes the name and settings of the group. Only the group's
+// owner can change them.
+func (s *Server) updateGroup(w http.ResponseWriter, r *http.Request) {
+	userID, _ := s.authUserID(r)
+	member, err := s.storeFor(r).GetMember(groupID(r), userID)
+	if err != nil || member.Role != RoleOwner {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	req := GroupRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	group, err := s.storeFor(r).UpdateGroup(groupID(r), req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, group)
+}
+
+// getMembers returns the members of the group.
+func (s *Server) getMembers(w http.ResponseWriter, r *http.Request) {
+	members, err := s.storeFor(r).GetMembers(groupID(r))
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+// requireMember only lets requests through from logged in members of the group
+// in the path.
+func (s *Server) requireMember(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := s.authUserID(r)
+		if !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		if _, err := s.storeFor(r).GetMember(groupID(r), userID); err != nil {
+			writeError(w, ErrNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireGroupAdmin only lets requests through from the owner of the group in
+// the path, or from admins.
+func (s *Server) requireGroupAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := s.authUserID(r)
+		if !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		if !s.isAdmin(r) {
+			member, err := s.storeFor(r).GetMember(groupID(r), userID)
+			if err != nil || member.Role != RoleOwner {
+				writeError(w, ErrForbidden)
+				return
+			}
+		}
+
+		next(w, r)
+	})
+}
+
+// groupID returns the group id in the path, or the default group's ID for
+// routes outside /api/group.
+func groupID(r *http.Request) int64 {
+	id, err := strconv.ParseInt(mux.Vars(r)["gid"], 10, 64)
+	if err != nil {
+		return defaultGroupID
+	}
+	return id
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readyTimeout limits how long the readiness checks may take.
+const readyTimeout = 5 * time.Second
+
+// healthz reports that the process is alive and serving requests.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Health{Status: HealthOK})
+}
+
+// readyz reports whether the app can serve requests: the db can be reached,
+// its migrations are applied and the session store can be read. It responds
+// with 503 Service Unavailable if any check fails.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]func() error{
+		"db":         func() error { return s.store.Ping(ctx) },
+		"migrations": s.store.CheckMigrations,
+		"sessions": func() error {
+			_, _, err := s.sessionManager.Store.Find("readyz")
+			return err
+		},
+	}
+
+	health := Health{Status: HealthOK, Checks: map[string]string{}}
+	status := http.StatusOK
+	for name, check := range checks {
+		if err := check(); err != nil {
+			logger(r.Context()).Error("readiness check failed", "check", name, "error", err)
+			health.Checks[name] = err.Error()
+			health.Status = HealthFail
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		health.Checks[name] = HealthOK
+	}
+
+	writeJSON(w, status, health)
+}
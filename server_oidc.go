@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// oidcLogin sends the user to the OpenID Connect provider to log in. The
+// state, nonce and PKCE verifier of the attempt are kept in the session.
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	secrets := map[string]string{}
+	for _, key := range []string{"oidc_state", "oidc_nonce", "oidc_verifier"} {
+		value, err := randomToken()
+		if err != nil {
+			writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		secrets[key] = value
+		s.sessionManager.Put(r.Context(), key, value)
+	}
+
+	authURL, err := s.oidc.authCodeURL(r.Context(),
+		secrets["oidc_state"], secrets["oidc_nonce"], secrets["oidc_verifier"])
+	if err != nil {
+		logger(r.Context()).Error("error starting OIDC login", "error", err)
+		writeError(w, NewServerError(http.StatusBadGateway, "identity provider unavailable"))
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallback logs in the user the OpenID Connect provider sent back. An
+// identity not linked to a user yet is linked to the logged in user, if any,
+// or to a new user if the signup mode allows it. Identities linked to inactive
+// users are rejected.
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	store := s.storeFor(r)
+
+	if s.oidc == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	state := s.sessionManager.PopString(r.Context(), "oidc_state")
+	nonce := s.sessionManager.PopString(r.Context(), "oidc_nonce")
+	verifier := s.sessionManager.PopString(r.Context(), "oidc_verifier")
+
+	sent := r.URL.Query().Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(state)) != 1 {
+		writeError(w, NewServerError(http.StatusUnauthorized, "invalid login state"))
+		return
+	}
+
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		writeError(w, NewServerError(http.StatusUnauthorized, "login failed: "+msg))
+		return
+	}
+
+	claims, err := s.oidc.exchange(r.Context(), r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		logger(r.Context()).Error("error completing OIDC login", "error", err)
+		writeError(w, NewServerError(http.StatusUnauthorized, "login failed"))
+		return
+	}
+
+	user, err := store.GetUserByIdentity(claims.Issuer, claims.Subject)
+	if errors.Is(err, ErrNotFound) {
+		if userID, ok := s.authUserID(r); ok {
+			err = store.LinkIdentity(userID, claims.Issuer, claims.Subject)
+			if err == nil {
+				user, err = store.GetUserByID(userID)
+			}
+		} else {
+			user, err = store.ProvisionUser(claims.Issuer, claims.Subject, claims.username())
+		}
+	}
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	if err := s.startSession(r, user); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	logger(r.Context()).Info("Logged in user with OIDC", "user", user.Name, "ID", user.ID)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// changePassword sets a new password for the logged in user, who must give
+// their current one. Wrong current passwords count as failed logins, so
+// guesses are throttled as they are by loginUser. The user's other sessions
+// are logged out.
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	store := s.storeFor(r)
+
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	req := ChangePasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	user, err := store.GetUserByID(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	ip := remoteIP(r)
+
+	wait, err := store.LoginRetryAfter(user.Name, ip)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	if wait > 0 {
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	version, err := store.ChangePassword(userID, req)
+	if err != nil {
+		serverError := err.(ServerError)
+		if serverError.Code == http.StatusUnauthorized {
+			if err := store.RecordLoginFailure(user.Name, ip); err != nil {
+				logger(r.Context()).Error("error recording failed login", "error", err)
+			}
+		}
+		writeError(w, serverError)
+		return
+	}
+
+	if err := store.ResetLoginFailures(user.Name, ip); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+	s.audit(r, AuditPasswordChange, AuditTargetUser, userID, nil, nil)
+
+	// Keep this session logged in.
+	if err := s.sessionManager.RenewToken(r.Context()); err != nil {
+		writeError(w, NewServerError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	s.sessionManager.Put(r.Context(), "session_version", version)
+
+	sessionID := s.sessionManager.GetInt64(r.Context(), "session_id")
+	if err := store.RevokeSessions(userID, sessionID); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// createPasswordReset creates a reset token for the user with the given id,
+// for an admin to pass on to the user.
+func (s *Server) createPasswordReset(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := s.authUserID(r)
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	reset, err := s.storeFor(r).CreatePasswordReset(userID, adminID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, reset)
+}
+
+// resetPassword sets a new password for the user of a reset token. All of the
+// user's sessions are logged out.
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	req := ResetPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	if err := s.storeFor(r).ResetPassword(req); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// getSessions returns the logged in user's sessions.
+func (s *Server) getSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := s.storeFor(r).GetSessions(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	current := s.sessionManager.GetInt64(r.Context(), "session_id")
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// revokeSession logs out the logged in user's session with the given id.
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	if err := s.storeFor(r).RevokeSession(userID, id); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// revokeSessions logs out all of the logged in user's sessions, including
+// the current one.
+func (s *Server) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.storeFor(r).RevokeSessions(userID, 0); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	for _, key := range sessionUserKeys {
+		s.sessionManager.Remove(r.Context(), key)
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// getSignupSettings returns who can register.
+func (s *Server) getSignupSettings(w http.ResponseWriter, r *http.Request) {
+	mode, err := s.storeFor(r).GetSignupMode()
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SignupSettings{Mode: mode})
+}
+
+// updateSignupSettings changes who can register.
+func (s *Server) updateSignupSettings(w http.ResponseWriter, r *http.Request) {
+	settings := SignupSettings{}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	if err := s.storeFor(r).SetSignupMode(settings.Mode); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// createInvite creates an invite on behalf of the logged in admin.
+func (s *Server) createInvite(w http.ResponseWriter, r *http.Request) {
+	userID, _ := s.authUserID(r)
+
+	req := InviteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	invite, err := s.storeFor(r).CreateInvite(userID, req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// getInvites returns all invites and who registered with them.
+func (s *Server) getInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := s.storeFor(r).GetInvites()
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, invites)
+}
+
+// requireAdmin only lets requests through from logged in admins, or admins'
+// API tokens with the admin scope.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := s.authUserID(r)
+		if !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		user, err := s.storeFor(r).GetUserByID(userID)
+		if err != nil || !user.Admin {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		if token := apiToken(r.Context()); token != nil && !token.HasScope(ScopeAdmin) {
+			writeError(w, NewServerError(http.StatusForbidden,
+				"API token needs the admin scope"))
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// requireSelfOrAdmin only lets requests through from the logged in user whose
+// id is in the path, or from admins as requireAdmin does.
+func (s *Server) requireSelfOrAdmin(next http.HandlerFunc) http.Handler {
+	admin := s.requireAdmin(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := s.authUserID(r)
+		if !ok {
+			writeError(w, ErrUnauthorized)
+			return
+		}
+
+		if mux.Vars(r)["id"] == strconv.FormatInt(userID, 10) {
+			next(w, r)
+			return
+		}
+
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether the request was made by an admin, with the admin
+// scope if it used an API token.
+func (s *Server) isAdmin(r *http.Request) bool {
+	userID, ok := s.authUserID(r)
+	if !ok {
+		return false
+	}
+
+	user, err := s.storeFor(r).GetUserByID(userID)
+	if err != nil || !user.Admin {
+		return false
+	}
+
+	token := apiToken(r.Context())
+	return token == nil || token.HasScope(ScopeAdmin)
+}
@@ -0,0 +1,1177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTestServer starts a server on an in-memory store with one user, John Doe,
+// whose password is "password".
+func newTestServer(t *testing.T) (*httptest.Server, *Store) {
+	store, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	_, err = store.CreateUser(NewUserRequest{"John Doe", "password"})
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(NewServer(":0", store).routes())
+	t.Cleanup(ts.Close)
+	return ts, store
+}
+
+// newTestClient returns a client that keeps session cookies.
+func newTestClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	assert.NoError(t, err)
+	return &http.Client{Jar: jar}
+}
+
+// getCSRFToken returns the CSRF token of the client's session.
+func getCSRFToken(t *testing.T, ts *httptest.Server, client *http.Client) string {
+	resp, err := client.Get(ts.URL + "/api/csrf")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body := map[string]string{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.NotEmpty(t, body["token"])
+	return body["token"]
+}
+
+// postLogin posts John Doe's login form with the given CSRF token header and
+// form value, leaving out the ones that are empty.
+func postLogin(t *testing.T, ts *httptest.Server, client *http.Client, header, field string) int {
+	form := url.Values{"username": {"John Doe"}, "password": {"password"}}
+	if field != "" {
+		form.Set("csrf_token", field)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/login",
+		strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		req.Header.Set("X-CSRF-Token", header)
+	}
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCSRF(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	t.Run("safe methods don't need a token", func(t *testing.T) {
+		resp, err := newTestClient(t).Get(ts.URL + "/api/signup")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("rejects posts without a token", func(t *testing.T) {
+		client := newTestClient(t)
+		getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, client, "", ""))
+	})
+
+	t.Run("rejects posts without a session", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, newTestClient(t), "", ""))
+	})
+
+	t.Run("rejects wrong tokens", func(t *testing.T) {
+		client := newTestClient(t)
+		token := getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, client, token+"x", ""))
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, client, "", token[1:]))
+	})
+
+	t.Run("rejects a wrong header even with the right form value", func(t *testing.T) {
+		client := newTestClient(t)
+		token := getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, client, "wrong", token))
+	})
+
+	t.Run("rejects tokens of another session", func(t *testing.T) {
+		token := getCSRFToken(t, ts, newTestClient(t))
+
+		client := newTestClient(t)
+		getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusForbidden, postLogin(t, ts, client, token, ""))
+	})
+
+	t.Run("rejects other state-changing methods", func(t *testing.T) {
+		client := newTestClient(t)
+		getCSRFToken(t, ts, client)
+
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			req, err := http.NewRequest(method, ts.URL+"/api/user/1", nil)
+			assert.NoError(t, err)
+			resp, err := client.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, method)
+		}
+	})
+
+	t.Run("accepts the token in the header", func(t *testing.T) {
+		client := newTestClient(t)
+		token := getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, token, ""))
+	})
+
+	t.Run("accepts the token in the form", func(t *testing.T) {
+		client := newTestClient(t)
+		token := getCSRFToken(t, ts, client)
+		assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, "", token))
+	})
+
+	t.Run("adds the token to pages", func(t *testing.T) {
+		client := newTestClient(t)
+		resp, err := client.Get(ts.URL + "/")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		page := new(strings.Builder)
+		_, err = io.Copy(page, resp.Body)
+		assert.NoError(t, err)
+
+		token := getCSRFToken(t, ts, client)
+		assert.Contains(t, page.String(), `name="csrf_token" value="`+token+`"`)
+		assert.Regexp(t, regexp.MustCompile(`hx-headers="{&#34;X-CSRF-Token&#34;: &#34;`+
+			regexp.QuoteMeta(token)), page.String())
+	})
+}
+
+// doWithToken makes a request with the given API token and JSON body and
+// returns the response status.
+func doWithToken(t *testing.T, ts *httptest.Server, method, path, token, body string) int {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAPITokens(t *testing.T) {
+	ts, store := newTestServer(t)
+
+	read, err := store.CreateAPIToken(1, APITokenRequest{Name: "results", Scopes: []TokenScope{ScopeRead}})
+	assert.NoError(t, err)
+	vote, err := store.CreateAPIToken(1, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeVote}})
+	assert.NoError(t, err)
+
+	t.Run("rejects unknown tokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized,
+			doWithToken(t, ts, http.MethodGet, "/api/song", "sv_nope", ""))
+	})
+
+	t.Run("read scope can only read", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK,
+			doWithToken(t, ts, http.MethodGet, "/api/song", read.Token, ""))
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodPost, "/api/song", read.Token, `{"title": "Stay", "artist": "Oingo Boingo"}`))
+	})
+
+	t.Run("vote scope can add songs without a CSRF token", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated,
+			doWithToken(t, ts, http.MethodPost, "/api/song", vote.Token, `{"title": "Stay", "artist": "Oingo Boingo"}`))
+		assert.Equal(t, http.StatusOK,
+			doWithToken(t, ts, http.MethodGet, "/api/group/1/song", vote.Token, ""))
+	})
+
+	t.Run("admin routes need the admin scope", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodGet, "/api/invite", vote.Token, ""))
+
+		admin, err := store.CreateAPIToken(1, APITokenRequest{Name: "admin", Scopes: []TokenScope{ScopeAdmin}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK,
+			doWithToken(t, ts, http.MethodGet, "/api/invite", admin.Token, ""))
+	})
+
+	t.Run("account routes need the account scope", func(t *testing.T) {
+		_, err := store.CreateUser(NewUserRequest{"Jane Doe", "password"})
+		assert.NoError(t, err)
+		admin, err := store.CreateAPIToken(1, APITokenRequest{Name: "admin", Scopes: []TokenScope{ScopeAdmin}})
+		assert.NoError(t, err)
+
+		for _, token := range []string{vote.Token, admin.Token} {
+			assert.Equal(t, http.StatusForbidden,
+				doWithToken(t, ts, http.MethodPut, "/api/user/1", token, `{"name": "John Roe"}`))
+			assert.Equal(t, http.StatusForbidden,
+				doWithToken(t, ts, http.MethodDelete, "/api/user/2", token, ""))
+			assert.Equal(t, http.StatusForbidden,
+				doWithToken(t, ts, http.MethodPost, "/api/group", token, `{"name": "Band"}`))
+			assert.Equal(t, http.StatusForbidden,
+				doWithToken(t, ts, http.MethodPut, "/api/v1/group/1", token, `{"song_quota": 4}`))
+			assert.Equal(t, http.StatusForbidden,
+				doWithToken(t, ts, http.MethodPost, "/api/group/join", token, `{"invite_code": "x"}`))
+		}
+
+		account, err := store.CreateAPIToken(1, APITokenRequest{Name: "account", Scopes: []TokenScope{ScopeAccount}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated,
+			doWithToken(t, ts, http.MethodPost, "/api/group", account.Token, `{"name": "Band"}`))
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodGet, "/api/song", account.Token, ""))
+
+		// Deleting other users takes the admin scope as well.
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodDelete, "/api/user/2", account.Token, ""))
+		both, err := store.CreateAPIToken(1, APITokenRequest{Name: "both",
+			Scopes: []TokenScope{ScopeAccount, ScopeAdmin}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent,
+			doWithToken(t, ts, http.MethodDelete, "/api/user/2", both.Token, ""))
+	})
+
+	t.Run("tokens can't manage sessions or passwords", func(t *testing.T) {
+		account, err := store.CreateAPIToken(1, APITokenRequest{Name: "sessions",
+			Scopes: []TokenScope{ScopeAccount, ScopeAdmin}})
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodDelete, "/api/me/sessions", account.Token, ""))
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodDelete, "/api/me/sessions/1", account.Token, ""))
+		assert.Equal(t, http.StatusForbidden, doWithToken(t, ts, http.MethodPut, "/api/password",
+			account.Token, `{"current_password": "password", "new_password": "secret"}`))
+	})
+
+	t.Run("tokens can't manage tokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden,
+			doWithToken(t, ts, http.MethodGet, "/api/token", vote.Token, ""))
+	})
+
+	t.Run("revoked tokens stop working", func(t *testing.T) {
+		assert.NoError(t, store.RevokeAPIToken(1, read.ID))
+		assert.Equal(t, http.StatusUnauthorized,
+			doWithToken(t, ts, http.MethodGet, "/api/song", read.Token, ""))
+	})
+}
+
+// putJSON makes a PUT request with the given CSRF token and JSON body and
+// returns the response status.
+func putJSON(t *testing.T, ts *httptest.Server, client *http.Client, path, token, body string) int {
+	return doJSON(t, ts, client, http.MethodPut, path, token, body)
+}
+
+// doJSON makes a request with the given CSRF token and JSON body and returns
+// the response status.
+func doJSON(t *testing.T, ts *httptest.Server, client *http.Client, method, path, token, body string) int {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("X-CSRF-Token", token)
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// loginAs logs the client in as the named user, whose password is "password",
+// and returns the CSRF token of its session.
+func loginAs(t *testing.T, ts *httptest.Server, client *http.Client, name string) string {
+	token := getCSRFToken(t, ts, client)
+	form := url.Values{"username": {name}, "password": {"password"}, "csrf_token": {token}}
+
+	resp, err := client.PostForm(ts.URL+"/api/login", form)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	return token
+}
+
+func TestChangePassword(t *testing.T) {
+	ts, store := newTestServer(t)
+
+	// loggedIn returns whether the client's session is logged in.
+	loggedIn := func(t *testing.T, client *http.Client) bool {
+		resp, err := client.Get(ts.URL + "/api/group")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	client := newTestClient(t)
+	token := getCSRFToken(t, ts, client)
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, token, ""))
+
+	other := newTestClient(t)
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, other, getCSRFToken(t, ts, other), ""))
+
+	t.Run("user updates can't change the password", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, putJSON(t, ts, client, "/api/user/1", token,
+			`{"name": "John Doe", "password": "new_password"}`))
+	})
+
+	t.Run("rejects the wrong current password", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, putJSON(t, ts, client, "/api/password", token,
+			`{"current_password": "wrong", "new_password": "new_password"}`))
+		assert.True(t, loggedIn(t, other))
+	})
+
+	t.Run("change logs out the other sessions only", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, putJSON(t, ts, client, "/api/password", token,
+			`{"current_password": "password", "new_password": "new_password"}`))
+
+		assert.True(t, loggedIn(t, client))
+		assert.False(t, loggedIn(t, other))
+
+		log, err := store.GetAuditLog(AuditFilter{Action: AuditPasswordChange})
+		assert.NoError(t, err)
+		assert.Len(t, log, 1)
+		assert.Equal(t, int64(1), log[0].TargetID)
+	})
+
+	t.Run("throttles current password guesses", func(t *testing.T) {
+		status := http.StatusUnauthorized
+		for i := 0; i < loginMaxFailures && status == http.StatusUnauthorized; i++ {
+			status = putJSON(t, ts, client, "/api/password", token,
+				`{"current_password": "wrong", "new_password": "guessed"}`)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, status)
+
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/password", strings.NewReader(
+			`{"current_password": "new_password", "new_password": "guessed"}`))
+		assert.NoError(t, err)
+		req.Header.Set("X-CSRF-Token", token)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	})
+}
+
+func TestSessions(t *testing.T) {
+	ts, store := newTestServer(t)
+
+	// loggedIn returns whether the client's session is logged in.
+	loggedIn := func(t *testing.T, client *http.Client) bool {
+		resp, err := client.Get(ts.URL + "/api/group")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	// getSessions returns the client's user's sessions.
+	getSessions := func(t *testing.T, client *http.Client) []Session {
+		resp, err := client.Get(ts.URL + "/api/me/sessions")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		sessions := []Session{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+		return sessions
+	}
+
+	// deleteSessions sends a DELETE request to path with the client.
+	deleteSessions := func(t *testing.T, client *http.Client, path, token string) int {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("X-CSRF-Token", token)
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	clients := make([]*http.Client, 3)
+	tokens := make([]string, 3)
+	for i := range clients {
+		clients[i] = newTestClient(t)
+		tokens[i] = getCSRFToken(t, ts, clients[i])
+		assert.Equal(t, http.StatusNoContent, postLogin(t, ts, clients[i], tokens[i], ""))
+	}
+
+	t.Run("lists the sessions and marks the current one", func(t *testing.T) {
+		sessions := getSessions(t, clients[0])
+		assert.Len(t, sessions, 3)
+
+		current := 0
+		for _, session := range sessions {
+			assert.Equal(t, "127.0.0.1", session.IP)
+			assert.Contains(t, session.UserAgent, "Go-http-client")
+			if session.Current {
+				current++
+			}
+		}
+		assert.Equal(t, 1, current)
+	})
+
+	t.Run("revokes another session", func(t *testing.T) {
+		var other int64
+		for _, session := range getSessions(t, clients[1]) {
+			if session.Current {
+				other = session.ID
+			}
+		}
+
+		assert.Equal(t, http.StatusNoContent,
+			deleteSessions(t, clients[0], fmt.Sprintf("/api/me/sessions/%d", other), tokens[0]))
+		assert.Equal(t, http.StatusNotFound,
+			deleteSessions(t, clients[0], fmt.Sprintf("/api/me/sessions/%d", other), tokens[0]))
+
+		assert.True(t, loggedIn(t, clients[0]))
+		assert.False(t, loggedIn(t, clients[1]))
+		assert.True(t, loggedIn(t, clients[2]))
+	})
+
+	t.Run("logs out everywhere", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent,
+			deleteSessions(t, clients[0], "/api/me/sessions", tokens[0]))
+
+		assert.False(t, loggedIn(t, clients[0]))
+		assert.False(t, loggedIn(t, clients[2]))
+	})
+
+	t.Run("deleting the user revokes its sessions", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, postLogin(t, ts, clients[0], tokens[0], ""))
+		assert.True(t, loggedIn(t, clients[0]))
+
+		assert.NoError(t, store.DeleteUser(1))
+		assert.False(t, loggedIn(t, clients[0]))
+
+		sessions, err := store.GetSessions(1)
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+	})
+}
+
+func TestCurrentUser(t *testing.T) {
+	ts, _ := newTestServer(t)
+	client := newTestClient(t)
+
+	resp, err := client.Get(ts.URL + "/api/me")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, getCSRFToken(t, ts, client), ""))
+
+	resp, err = client.Get(ts.URL + "/api/me")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	me := CurrentUser{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&me))
+	assert.Equal(t, "John Doe", me.Name)
+	assert.Equal(t, RoleAdmin, me.Role)
+	assert.Equal(t, defaultSongQuota, me.SongsRemaining)
+	assert.Len(t, me.Groups, 1)
+}
+
+func TestUserAuthorization(t *testing.T) {
+	ts, store := newTestServer(t)
+	_, err := store.CreateUser(NewUserRequest{"Jane Doe", "password"})
+	assert.NoError(t, err)
+	_, err = store.CreateUser(NewUserRequest{"Max Doe", "password"})
+	assert.NoError(t, err)
+
+	anonymous := newTestClient(t)
+	anonymousToken := getCSRFToken(t, ts, anonymous)
+	jane := newTestClient(t)
+	janeToken := loginAs(t, ts, jane, "Jane Doe")
+	admin := newTestClient(t)
+	adminToken := loginAs(t, ts, admin, "John Doe")
+
+	t.Run("anonymous clients can't change users", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodPut,
+			"/api/user/2", anonymousToken, `{"name": "Mallory", "vetoes": 1}`))
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodDelete,
+			"/api/user/2", anonymousToken, ""))
+	})
+
+	t.Run("users can't change other users", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, jane, http.MethodPut,
+			"/api/user/3", janeToken, `{"name": "Mallory", "vetoes": 1}`))
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, jane, http.MethodDelete,
+			"/api/user/3", janeToken, ""))
+
+		user, err := store.GetUserByID(3)
+		assert.NoError(t, err)
+		assert.Equal(t, "Max Doe", user.Name)
+		assert.False(t, user.Inactive)
+	})
+
+	t.Run("users rename themselves but can't change their vetoes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, jane, http.MethodPut,
+			"/api/user/2", janeToken, `{"name": "Jane Roe", "vetoes": 1}`))
+		assert.Equal(t, http.StatusForbidden, doJSON(t, ts, jane, http.MethodPut,
+			"/api/user/2", janeToken, `{"name": "Jane Roe", "vetoes": 5}`))
+
+		user, err := store.GetUserByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Roe", user.Name)
+		assert.Equal(t, initialVetoes, user.Vetoes)
+	})
+
+	t.Run("admins change vetoes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, admin, http.MethodPut,
+			"/api/user/2", adminToken, `{"name": "Jane Roe", "vetoes": 5}`))
+
+		user, err := store.GetUserByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, user.Vetoes)
+	})
+
+	t.Run("users leave out their vetoes to keep them", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, jane, http.MethodPut,
+			"/api/user/2", janeToken, `{"name": "Jane Doe"}`))
+
+		user, err := store.GetUserByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Doe", user.Name)
+		assert.Equal(t, 5, user.Vetoes)
+	})
+
+	t.Run("users delete themselves and admins delete others", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, doJSON(t, ts, jane, http.MethodDelete,
+			"/api/user/2", janeToken, ""))
+		assert.Equal(t, http.StatusNoContent, doJSON(t, ts, admin, http.MethodDelete,
+			"/api/user/3", adminToken, ""))
+	})
+}
+
+func TestRoundAuthorization(t *testing.T) {
+	ts, store := newTestServer(t)
+	for _, name := range []string{"Jane Doe", "Max Doe"} {
+		_, err := store.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+	band, err := store.CreateGroup(2, GroupRequest{Name: "Band"})
+	assert.NoError(t, err)
+	_, err = store.JoinGroup(3, band.InviteCode)
+	assert.NoError(t, err)
+
+	anonymous := newTestClient(t)
+	anonymousToken := getCSRFToken(t, ts, anonymous)
+	jane := newTestClient(t)
+	janeToken := loginAs(t, ts, jane, "Jane Doe")
+	max := newTestClient(t)
+	maxToken := loginAs(t, ts, max, "Max Doe")
+	admin := newTestClient(t)
+	adminToken := loginAs(t, ts, admin, "John Doe")
+	bandRound := fmt.Sprintf("/api/group/%d/round", band.ID)
+
+	t.Run("anonymous clients can't change rounds", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodPost,
+			"/api/round", anonymousToken, ""))
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodPut,
+			"/api/round", anonymousToken, `{"vote_budget": 100}`))
+	})
+
+	t.Run("members can't change rounds", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, doJSON(t, ts, jane, http.MethodPost,
+			"/api/round", janeToken, ""))
+		assert.Equal(t, http.StatusForbidden, doJSON(t, ts, jane, http.MethodPut,
+			"/api/round", janeToken, `{"vote_budget": 100}`))
+		assert.Equal(t, http.StatusForbidden, doJSON(t, ts, max, http.MethodPost,
+			bandRound, maxToken, ""))
+
+		rounds, err := store.GetRounds(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Len(t, rounds, 1)
+		assert.Equal(t, defaultVoteBudget, rounds[0].VoteBudget)
+	})
+
+	t.Run("only owners change their group", func(t *testing.T) {
+		bandPath := fmt.Sprintf("/api/group/%d", band.ID)
+		assert.Equal(t, http.StatusForbidden, doJSON(t, ts, max, http.MethodPut,
+			bandPath, maxToken, `{"song_quota": 10}`))
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, jane, http.MethodPut,
+			bandPath, janeToken, `{"song_quota": 10}`))
+	})
+
+	t.Run("group owners change their group's rounds", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, doJSON(t, ts, jane, http.MethodPost,
+			bandRound, janeToken, ""))
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, jane, http.MethodPut,
+			bandRound, janeToken, `{"vote_budget": 10}`))
+	})
+
+	t.Run("only members see a group's users", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodGet,
+			"/api/user", anonymousToken, ""))
+		assert.Equal(t, http.StatusUnauthorized, doJSON(t, ts, anonymous, http.MethodGet,
+			"/api/user/1/profile", anonymousToken, ""))
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, max, http.MethodGet,
+			fmt.Sprintf("/api/group/%d/user", band.ID), maxToken, ""))
+		assert.Equal(t, http.StatusNotFound, doJSON(t, ts, max, http.MethodGet,
+			fmt.Sprintf("/api/group/%d/user/1/profile", band.ID), maxToken, ""))
+		assert.Equal(t, http.StatusNotFound, doJSON(t, ts, admin, http.MethodGet,
+			fmt.Sprintf("/api/group/%d/user", band.ID), adminToken, ""))
+	})
+
+	t.Run("admins change any group's rounds", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, doJSON(t, ts, admin, http.MethodPost,
+			"/api/round", adminToken, ""))
+		assert.Equal(t, http.StatusOK, doJSON(t, ts, admin, http.MethodPut,
+			"/api/round", adminToken, `{"vote_budget": 10}`))
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	ts, store := newTestServer(t)
+	_, err := store.CreateUser(NewUserRequest{"Jane Doe", "password"})
+	assert.NoError(t, err)
+	_, err = store.CreateSong(NewSongRequest{defaultGroupID, 1, "Song", "Artist", ""})
+	assert.NoError(t, err)
+
+	admin, err := store.CreateAPIToken(1, APITokenRequest{Name: "audit", Scopes: []TokenScope{ScopeAdmin}})
+	assert.NoError(t, err)
+	voter, err := store.CreateAPIToken(2, APITokenRequest{Name: "votes", Scopes: []TokenScope{ScopeVote}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, doWithToken(t, ts, http.MethodPost, "/api/song/1/vote",
+		voter.Token, ""))
+	assert.Equal(t, http.StatusCreated, doWithToken(t, ts, http.MethodPost, "/api/song/1/veto",
+		voter.Token, ""))
+
+	t.Run("records actions with their actor and request", func(t *testing.T) {
+		log, err := store.GetAuditLog(AuditFilter{ActorID: 2})
+		assert.NoError(t, err)
+		assert.Len(t, log, 2)
+		assert.Equal(t, AuditVetoCreate, log[0].Action)
+		assert.Equal(t, AuditVoteCreate, log[1].Action)
+		assert.Equal(t, int64(1), log[1].TargetID)
+		assert.NotEmpty(t, log[1].RequestID)
+	})
+
+	t.Run("only admins can query the log", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, doWithToken(t, ts, http.MethodGet,
+			"/api/audit", voter.Token, ""))
+		assert.Equal(t, http.StatusOK, doWithToken(t, ts, http.MethodGet,
+			"/api/audit?actor=2&action=vote.create", admin.Token, ""))
+		assert.Equal(t, http.StatusBadRequest, doWithToken(t, ts, http.MethodGet,
+			"/api/audit?since=yesterday", admin.Token, ""))
+	})
+}
+
+func TestUserData(t *testing.T) {
+	ts, store := newTestServer(t)
+	_, err := store.CreateUser(NewUserRequest{"Jane Doe", "password"})
+	assert.NoError(t, err)
+
+	admin, err := store.CreateAPIToken(1, APITokenRequest{Name: "admin", Scopes: []TokenScope{ScopeAdmin}})
+	assert.NoError(t, err)
+
+	client := newTestClient(t)
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, getCSRFToken(t, ts, client), ""))
+
+	t.Run("users export their own data", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/api/me/export")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+
+		export := UserExport{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&export))
+		assert.Equal(t, "John Doe", export.User.Name)
+		assert.Len(t, export.Sessions, 1)
+	})
+
+	t.Run("admins export and erase users", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, doWithToken(t, ts, http.MethodGet,
+			"/api/user/2/export", admin.Token, ""))
+		assert.NoError(t, store.DeleteUser(2))
+		assert.Equal(t, http.StatusOK, doWithToken(t, ts, http.MethodGet,
+			"/api/user/2/export", admin.Token, ""))
+		assert.Equal(t, http.StatusNoContent, doWithToken(t, ts, http.MethodPost,
+			"/api/user/2/erase", admin.Token, ""))
+		assert.Equal(t, http.StatusNotFound, doWithToken(t, ts, http.MethodGet,
+			"/api/user/2/export", admin.Token, ""))
+
+		log, err := store.GetAuditLog(AuditFilter{Action: AuditUserErase})
+		assert.NoError(t, err)
+		assert.Len(t, log, 1)
+	})
+}
+
+func TestRequestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	ts, _ := newTestServer(t)
+	client := newTestClient(t)
+	token := getCSRFToken(t, ts, client)
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, token, ""))
+
+	// records returns the log records with the given request ID.
+	records := func(t *testing.T, id string) []map[string]any {
+		found := []map[string]any{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			record := map[string]any{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &record))
+			if record["request_id"] == id {
+				found = append(found, record)
+			}
+		}
+		return found
+	}
+
+	// send requests path with the given X-Request-ID header and returns the ID
+	// sent back.
+	send := func(t *testing.T, method, path, id string) string {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("X-Request-ID", id)
+		req.Header.Set("X-CSRF-Token", token)
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.Header.Get("X-Request-ID")
+	}
+
+	t.Run("logs the outcome of requests", func(t *testing.T) {
+		assert.Equal(t, "req-1", send(t, http.MethodGet, "/api/me", "req-1"))
+
+		found := records(t, "req-1")
+		assert.Len(t, found, 1)
+		assert.Equal(t, "HTTP request", found[0]["msg"])
+		assert.Equal(t, "/api/me", found[0]["path"])
+		assert.Equal(t, float64(http.StatusOK), found[0]["status"])
+		assert.Equal(t, float64(1), found[0]["user_id"])
+		assert.Equal(t, "127.0.0.1", found[0]["remote_addr"])
+		assert.Greater(t, found[0]["bytes"], float64(0))
+		assert.Contains(t, found[0], "duration")
+	})
+
+	t.Run("replaces invalid request IDs", func(t *testing.T) {
+		id := send(t, http.MethodGet, "/api/me", "not a valid id")
+		assert.NotEqual(t, "not a valid id", id)
+		assert.Len(t, records(t, id), 1)
+	})
+
+	t.Run("store calls log with the request ID", func(t *testing.T) {
+		send(t, http.MethodPost, "/api/logout", "req-2")
+
+		messages := []any{}
+		for _, record := range records(t, "req-2") {
+			messages = append(messages, record["msg"])
+		}
+		assert.Contains(t, messages, "Session revoked")
+		assert.Contains(t, messages, "HTTP request")
+	})
+}
+
+// scrapeMetrics returns the value of each series at /metrics, keyed by series
+// name and labels.
+func scrapeMetrics(t *testing.T, ts *httptest.Server) map[string]float64 {
+	resp, err := http.Get(ts.URL + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "version=0.0.4")
+	assert.Empty(t, resp.Cookies())
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	series := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		assert.NoError(t, err, line)
+		series[line[:i]] = value
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	ts, store := newTestServer(t)
+	vote, err := store.CreateAPIToken(1, APITokenRequest{Name: "bot",
+		Scopes: []TokenScope{ScopeVote, ScopeAdmin}})
+	assert.NoError(t, err)
+
+	client := newTestClient(t)
+	assert.Equal(t, http.StatusNoContent, postLogin(t, ts, client, getCSRFToken(t, ts, client), ""))
+
+	before := scrapeMetrics(t, ts)
+	assert.Equal(t, float64(1), before["songvote_active_sessions"])
+
+	assert.Equal(t, http.StatusCreated, doWithToken(t, ts, http.MethodPost, "/api/song",
+		vote.Token, `{"title": "Song", "artist": "Artist"}`))
+	assert.Equal(t, http.StatusCreated, doWithToken(t, ts, http.MethodPost, "/api/song/1/veto",
+		vote.Token, ""))
+	assert.Equal(t, http.StatusCreated, doWithToken(t, ts, http.MethodPost, "/api/round",
+		vote.Token, ""))
+
+	after := scrapeMetrics(t, ts)
+	delta := func(series string) float64 {
+		return after[series] - before[series]
+	}
+
+	t.Run("counts requests by route", func(t *testing.T) {
+		assert.Equal(t, float64(1),
+			delta(`songvote_http_requests_total{route="/api/song",method="POST",status="201"}`))
+		assert.Equal(t, float64(1),
+			delta(`songvote_http_request_duration_seconds_count{route="/api/song",method="POST"}`))
+		assert.Equal(t, float64(1),
+			delta(`songvote_http_request_duration_seconds_bucket{route="/api/song",method="POST",le="+Inf"}`))
+	})
+
+	t.Run("times database queries", func(t *testing.T) {
+		assert.Greater(t, delta(`songvote_db_query_duration_seconds_count{statement="insert"}`),
+			float64(0))
+	})
+
+	t.Run("counts domain events", func(t *testing.T) {
+		assert.Equal(t, float64(1), delta("songvote_songs_added_total"))
+		assert.Equal(t, float64(1), delta("songvote_votes_total"))
+		assert.Equal(t, float64(1), delta("songvote_vetoes_total"))
+		assert.Equal(t, float64(1), delta("songvote_rounds_closed_total"))
+	})
+}
+
+func TestHealth(t *testing.T) {
+	ts, store := newTestServer(t)
+
+	getHealth := func(t *testing.T, path string) (int, Health) {
+		resp, err := http.Get(ts.URL + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Empty(t, resp.Cookies())
+
+		var health Health
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		return resp.StatusCode, health
+	}
+
+	t.Run("reports the process alive", func(t *testing.T) {
+		status, health := getHealth(t, "/healthz")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, HealthOK, health.Status)
+	})
+
+	t.Run("reports ready with each check", func(t *testing.T) {
+		status, health := getHealth(t, "/readyz")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, Health{Status: HealthOK, Checks: map[string]string{
+			"db": HealthOK, "migrations": HealthOK, "sessions": HealthOK,
+		}}, health)
+	})
+
+	t.Run("reports not ready when a check fails", func(t *testing.T) {
+		_, err := store.db.Exec("ALTER TABLE users DROP COLUMN session_version")
+		assert.NoError(t, err)
+
+		status, health := getHealth(t, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, HealthFail, health.Status)
+		assert.Equal(t, HealthOK, health.Checks["db"])
+		assert.Contains(t, health.Checks["migrations"], "session_version")
+
+		status, _ = getHealth(t, "/healthz")
+		assert.Equal(t, http.StatusOK, status)
+	})
+}
+
+func TestTracing(t *testing.T) {
+	_, err := configureTracing("")
+	assert.NoError(t, err)
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	ts, store := newTestServer(t)
+	_, err = store.CreateUser(NewUserRequest{"Jane Doe", "password"})
+	assert.NoError(t, err)
+	_, err = store.CreateSong(NewSongRequest{defaultGroupID, 1, "Song", "Artist", ""})
+	assert.NoError(t, err)
+	voter, err := store.CreateAPIToken(2, APITokenRequest{Name: "votes", Scopes: []TokenScope{ScopeVote}})
+	assert.NoError(t, err)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/song/1/vote", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+voter.Token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// spanNamed returns the ended span of the request's trace with the given
+	// name.
+	spanNamed := func(name string) sdktrace.ReadOnlySpan {
+		for _, span := range spans.Ended() {
+			if span.Name() == name && span.SpanContext().TraceID().String() == traceID {
+				return span
+			}
+		}
+		t.Fatalf("no span named %q", name)
+		return nil
+	}
+
+	request := spanNamed("POST /api/song/{id}/vote")
+
+	t.Run("traces requests with their route, user and song", func(t *testing.T) {
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range request.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		assert.Equal(t, "/api/song/{id}/vote", attrs[semconv.HTTPRouteKey].AsString())
+		assert.Equal(t, int64(http.StatusCreated), attrs[semconv.HTTPStatusCodeKey].AsInt64())
+		assert.Equal(t, "2", attrs[semconv.EnduserIDKey].AsString())
+		assert.Equal(t, int64(1), attrs[songIDKey].AsInt64())
+	})
+
+	t.Run("traces store methods and their queries within requests", func(t *testing.T) {
+		vote := spanNamed("Store.VoteForSong")
+		assert.Equal(t, request.SpanContext().SpanID(), vote.Parent().SpanID())
+
+		statements := []string{}
+		for _, span := range spans.Ended() {
+			if span.Parent().SpanID() == vote.SpanContext().SpanID() {
+				statements = append(statements, span.Name())
+			}
+		}
+		assert.Contains(t, statements, "db insert")
+		assert.Contains(t, statements, "db update")
+	})
+
+	t.Run("query spans last until their rows are closed", func(t *testing.T) {
+		selects := func() int {
+			count := 0
+			for _, span := range spans.Ended() {
+				if span.Name() == "db select" {
+					count++
+				}
+			}
+			return count
+		}
+
+		before := selects()
+		rows, err := store.db.Query("SELECT id FROM votes")
+		assert.NoError(t, err)
+		assert.Equal(t, before, selects())
+
+		assert.NoError(t, rows.Close())
+		assert.Equal(t, before+1, selects())
+		assert.NoError(t, rows.Close())
+		assert.Equal(t, before+1, selects())
+	})
+
+	t.Run("includes trace IDs in log lines", func(t *testing.T) {
+		found := false
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			record := map[string]any{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &record))
+			if record["msg"] == "HTTP request" {
+				assert.Equal(t, traceID, record["trace_id"])
+				assert.Equal(t, request.SpanContext().SpanID().String(), record["span_id"])
+				found = true
+			}
+		}
+		assert.True(t, found)
+	})
+}
+
+func TestRateLimits(t *testing.T) {
+	store, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	_, err = store.CreateUser(NewUserRequest{"John Doe", "password"})
+	assert.NoError(t, err)
+	token, err := store.CreateAPIToken(1, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeAdmin}})
+	assert.NoError(t, err)
+
+	server := NewServer(":0", store)
+	server.SetRateLimits(RateLimitConfig{
+		Routes: map[string]RateLimit{
+			"POST /api/user":                 {PerMinute: 1, Burst: 2},
+			"GET /api/group/{gid}/analytics": {PerMinute: 1, Burst: 1},
+		},
+	})
+	now := time.Now()
+	server.limiter.now = func() time.Time { return now }
+	ts := httptest.NewServer(server.routes())
+	t.Cleanup(ts.Close)
+
+	// do makes a request, with an API token if one is given.
+	do := func(t *testing.T, method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader("{}"))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("limits requests of each IP address", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/api/user", "")
+		assert.NotEqual(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+		assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+		assert.Equal(t, "60", resp.Header.Get("RateLimit-Reset"))
+
+		assert.NotEqual(t, http.StatusTooManyRequests, do(t, http.MethodPost, "/api/user", "").StatusCode)
+
+		resp = do(t, http.MethodPost, "/api/user", "")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+		assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	})
+
+	t.Run("limits users apart from their IP address", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/api/user", token.Token)
+		assert.NotEqual(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+	})
+
+	t.Run("refills over time", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		assert.NotEqual(t, http.StatusTooManyRequests, do(t, http.MethodPost, "/api/user", "").StatusCode)
+		assert.Equal(t, http.StatusTooManyRequests, do(t, http.MethodPost, "/api/user", "").StatusCode)
+	})
+
+	t.Run("limits routes by their template", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK,
+			do(t, http.MethodGet, "/api/group/1/analytics", token.Token).StatusCode)
+		assert.Equal(t, http.StatusTooManyRequests,
+			do(t, http.MethodGet, "/api/group/1/analytics", token.Token).StatusCode)
+	})
+
+	t.Run("leaves other routes unlimited", func(t *testing.T) {
+		resp := do(t, http.MethodGet, "/api/user", token.Token)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("RateLimit-Limit"))
+	})
+
+	t.Run("drops the least recently seen clients", func(t *testing.T) {
+		limiter := newRateLimiter(RateLimitConfig{MaxClients: 2})
+		limit := RateLimit{PerMinute: 1, Burst: 1}
+		assert.True(t, limiter.take("a", limit).allowed)
+		assert.True(t, limiter.take("b", limit).allowed)
+		assert.False(t, limiter.take("a", limit).allowed)
+		assert.True(t, limiter.take("c", limit).allowed)
+		assert.Len(t, limiter.buckets, 2)
+		assert.True(t, limiter.take("b", limit).allowed)
+	})
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	// get requests path, marked as forwarded over TLS if tls is set.
+	get := func(t *testing.T, path string, tls bool) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		assert.NoError(t, err)
+		if tls {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("sets security headers", func(t *testing.T) {
+		for _, path := range []string{"/", "/api/user", "/healthz"} {
+			resp, _ := get(t, path, false)
+			assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"), path)
+			assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"), path)
+			assert.Equal(t, "strict-origin-when-cross-origin", resp.Header.Get("Referrer-Policy"), path)
+			assert.Contains(t, resp.Header.Get("Content-Security-Policy"), "frame-ancestors 'none'", path)
+			assert.Empty(t, resp.Header.Get("Strict-Transport-Security"), path)
+		}
+	})
+
+	t.Run("allows template scripts by nonce", func(t *testing.T) {
+		nonces := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			resp, body := get(t, "/", false)
+			match := regexp.MustCompile(`script-src 'nonce-([^']+)'`).
+				FindStringSubmatch(resp.Header.Get("Content-Security-Policy"))
+			assert.Len(t, match, 2)
+			nonce := match[1]
+			assert.Equal(t, 1, strings.Count(body, `<script nonce="`+nonce+`"`))
+			nonces[nonce] = true
+		}
+		assert.Len(t, nonces, 2)
+	})
+
+	t.Run("loads scripts and styles from the app", func(t *testing.T) {
+		_, body := get(t, "/", false)
+		assert.NotContains(t, body, "https://")
+
+		resp, css := get(t, "/static/app.css", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/css")
+		assert.Contains(t, css, ".bg-slate-800")
+
+		resp, js := get(t, "/static/htmx.min.js", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+		assert.Contains(t, js, `version:"1.9.10"`)
+	})
+
+	t.Run("enables HSTS behind TLS", func(t *testing.T) {
+		resp, _ := get(t, "/", true)
+		assert.Contains(t, resp.Header.Get("Strict-Transport-Security"), "max-age=")
+	})
+
+	t.Run("configures the session cookie", func(t *testing.T) {
+		store, err := NewStore(":memory:")
+		assert.NoError(t, err)
+		server := NewServer(":0", store)
+		server.ConfigureCookie(CookieConfig{Name: "songvote", Domain: "example.com", Secure: true})
+		ts := httptest.NewServer(server.routes())
+		t.Cleanup(ts.Close)
+
+		resp, err := http.Get(ts.URL + "/api/csrf")
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		cookie := resp.Header.Get("Set-Cookie")
+		assert.True(t, strings.HasPrefix(cookie, "songvote="), cookie)
+		assert.Contains(t, cookie, "Domain=example.com")
+		assert.Contains(t, cookie, "Secure")
+		assert.Contains(t, cookie, "HttpOnly")
+		assert.Contains(t, cookie, "SameSite=Lax")
+	})
+}
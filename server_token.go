@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// createAPIToken creates an API token for the logged in user.
+func (s *Server) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	req := APITokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	token, err := s.storeFor(r).CreateAPIToken(userID, req)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// getAPITokens returns the API tokens of the logged in user.
+func (s *Server) getAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := s.storeFor(r).GetAPITokens(userID)
+	if err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// revokeAPIToken deletes the logged in user's API token with the given id.
+func (s *Server) revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.sessionOnlyUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, ErrBadRequest)
+		return
+	}
+
+	if err := s.storeFor(r).RevokeAPIToken(userID, id); err != nil {
+		writeError(w, err.(ServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// sessionOnlyUserID returns the ID of the logged in user. API tokens can't be
+// used to manage API tokens. It writes an error response and returns false if
+// the request has no session user or uses an API token.
+func (s *Server) sessionOnlyUserID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if apiToken(r.Context()) != nil {
+		writeError(w, NewServerError(http.StatusForbidden,
+			"API tokens can't be used to manage API tokens"))
+		return 0, false
+	}
+
+	userID, ok := s.authUserID(r)
+	if !ok {
+		writeError(w, ErrUnauthorized)
+		return 0, false
+	}
+
+	return userID, true
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// staticFiles holds the scripts and styles the templates load, so pages don't
+// depend on other sites.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// staticHandler serves the files in the static directory under /static/.
+func staticHandler() http.Handler {
+	files, _ := fs.Sub(staticFiles, "static")
+	return http.StripPrefix("/static/", http.FileServer(http.FS(files)))
+}
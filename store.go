@@ -1,25 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
 )
 
 // Store contains data related to storage.
 type Store struct {
-	db *sql.DB
+	db  *timedDB
+	log *slog.Logger // logger of the request the store is used for, if any
 }
 
+// dbOptions are the connection options the db is opened with. Writers wait
+// for each other instead of failing with SQLITE_BUSY, and transactions take the
+// write lock when they begin, so they can't deadlock upgrading a read lock.
+const dbOptions = "_pragma=busy_timeout(5000)&_txlock=immediate"
+
 // NewStore creates a new SQLite3 database store.
 func NewStore(dbPath string) (*Store, error) {
 	slog.Info("Opening db", "path", dbPath)
 
-	db, err := sql.Open("sqlite", dbPath)
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite", dbPath+separator+dbOptions)
 	if err != nil {
 		return nil, fmt.Errorf("error opening db: %v", err)
 	}
@@ -29,7 +41,7 @@ func NewStore(dbPath string) (*Store, error) {
 	}
 	slog.Info("Connected to db.")
 
-	store := &Store{db}
+	store := &Store{db: &timedDB{DB: db, ctx: context.Background()}, log: slog.Default()}
 
 	if err := store.CreateTables(); err != nil {
 		return nil, fmt.Errorf("error creating tables: %v", err)
@@ -38,20 +50,65 @@ func NewStore(dbPath string) (*Store, error) {
 	return store, nil
 }
 
-// CreateUser creates a new user with the given request data.
+// WithRequest returns a store on the same db that logs to logger and traces
+// its queries as part of the request with context ctx.
+func (s *Store) WithRequest(ctx context.Context, logger *slog.Logger) *Store {
+	return &Store{db: &timedDB{DB: s.db.DB, ctx: ctx}, log: logger}
+}
+
+// trace starts the span of a Store method, and returns a store whose queries
+// are traced as part of it along with the function that ends it.
+func (s *Store) trace(method string) (*Store, func()) {
+	ctx, span := tracer().Start(s.db.ctx, "Store."+method)
+	return &Store{db: &timedDB{DB: s.db.DB, ctx: ctx}, log: s.log}, func() { span.End() }
+}
+
+// Ping checks that the db can be reached.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// CreateUser creates a new user with the given request data. The first user
+// becomes an admin.
 func (s *Store) CreateUser(req NewUserRequest) (int64, error) {
-	if s.usernameExists(req.Name) {
-		return 0, ErrConflict
+	s, end := s.trace("CreateUser")
+	defer end()
+
+	return s.createUser(req, nil)
+}
+
+// createUser creates a user in a transaction and adds them to the default
+// group. If then isn't nil, it is called with the transaction and the new
+// user's ID, and the user is only created if it succeeds.
+func (s *Store) createUser(req NewUserRequest, then func(tx *timedTx, id int64) error) (int64, error) {
+	if err := checkUserName(req.Name); err != nil {
+		return 0, err
 	}
 
-	pwd, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	pwd, err := hashPassword(s.db.ctx, req.Password)
 	if err != nil {
 		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
-	result, err := s.db.Exec(
-		`INSERT INTO users(name, password, inactive, vetoes) VALUES($1, $2, $3, $4)`,
-		req.Name, pwd, false, initialVetoes,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var users, taken int
+	row := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(name = $1), 0) FROM users", req.Name)
+	if err := row.Scan(&users, &taken); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if taken > 0 {
+		return 0, ErrConflict
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO users(name, password, inactive, admin, created_at, updated_at)
+		VALUES($1, $2, $3, $4, $5, $5)`,
+		req.Name, pwd, false, users == 0, time.Now().UTC(),
 	)
 	if err != nil {
 		return 0, NewServerError(http.StatusInternalServerError, err.Error())
@@ -59,31 +116,54 @@ func (s *Store) CreateUser(req NewUserRequest) (int64, error) {
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return id, NewServerError(http.StatusInternalServerError, err.Error())
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := s.addMember(tx, defaultGroupID, id, RoleMember); err != nil {
+		return 0, err
+	}
+
+	if then != nil {
+		if err := then(tx, id); err != nil {
+			return 0, err
+		}
 	}
 
-	slog.Info("New user created", "id", id, "name", req.Name)
+	if err := tx.Commit(); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("New user created", "id", id, "name", req.Name)
 	return id, nil
 }
 
-// GetUsers returns a list of all users.
-func (s *Store) GetUsers() ([]User, error) {
+// GetUsers returns a list of the members of a group created in the given time
+// range, with their vetoes and votes remaining in that group.
+func (s *Store) GetUsers(groupID int64, created TimeRange) ([]User, error) {
+	s, end := s.trace("GetUsers")
+	defer end()
+
 	users := []User{}
 
-	rows, err := s.db.Query(`SELECT id, name, inactive, vetoes FROM users`)
+	condition, args := created.condition("users.created_at", []any{groupID})
+	rows, err := s.db.Query(
+		`SELECT `+groupUserColumns(groupID)+` FROM users
+		JOIN group_members ON group_members.user_id = users.id
+		WHERE group_members.group_id = $1 AND `+condition, args...)
 	if err != nil {
-		slog.Error("error getting users from db", "error", err)
+		s.log.Error("error getting users from db", "error", err)
 		return nil, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
 	for rows.Next() {
-		user := User{}
-		err := rows.Scan(&user.ID, &user.Name, &user.Inactive, &user.Vetoes)
+		user, err := scanUser(rows)
 		if err != nil {
-			slog.Error("error scanning rows", "error", err)
+			s.log.Error("error scanning rows", "error", err)
+			continue
 		}
 		if !user.Inactive {
-			users = append(users, user)
+			user.Password = ""
+			users = append(users, *user)
 		}
 	}
 
@@ -93,23 +173,36 @@ func (s *Store) GetUsers() ([]User, error) {
 // GetUserByID returns user data that matches the given ID if that user is
 // not flagged as Inactive.
 func (s *Store) GetUserByID(id int64) (*User, error) {
-	user := User{}
+	s, end := s.trace("GetUserByID")
+	defer end()
 
-	row := s.db.QueryRow("SELECT * FROM users WHERE id = $1", id)
-	err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Inactive, &user.Vetoes)
+	user, err := s.getUserByID(id)
 	if err != nil || user.Inactive {
 		return nil, ErrNotFound
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+// getUserByID returns the user with the given ID, including inactive users.
+func (s *Store) getUserByID(id int64) (*User, error) {
+	row := s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return user, nil
 }
 
 // GetUserByName returns user data that matches the given username if that
 // user is not flagged as Inactive.
 func (s *Store) GetUserByName(username string) (*User, error) {
-	row := s.db.QueryRow("SELECT * FROM users WHERE name = $1", username)
-	user := &User{}
-	err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Inactive, &user.Vetoes)
+	s, end := s.trace("GetUserByName")
+	defer end()
+
+	row := s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE name = $1", username)
+	user, err := scanUser(row)
 	if err != nil || user.Inactive {
 		return nil, ErrNotFound
 	}
@@ -117,68 +210,104 @@ func (s *Store) GetUserByName(username string) (*User, error) {
 	return user, nil
 }
 
-// UpdateUser updates user information.
+// userColumns lists the users table columns in the order scanUser expects,
+// followed by the user's vetoes and votes remaining in the default group.
+var userColumns = groupUserColumns(defaultGroupID)
+
+// groupUserColumns is userColumns with the vetoes and votes remaining of the
+// user in the given group.
+func groupUserColumns(groupID int64) string {
+	return fmt.Sprintf(`users.id, users.name, users.password, users.inactive, users.admin,
+	users.session_version, users.created_at, users.updated_at, users.deleted_at,
+	COALESCE((SELECT vetoes FROM group_members
+		WHERE group_id = %[1]d AND user_id = users.id), 0),
+	COALESCE((SELECT votes_remaining FROM group_members
+		WHERE group_id = %[1]d AND user_id = users.id), 0)`, groupID)
+}
+
+// scanUser reads a user selected with userColumns.
+func scanUser(row scanner) (*User, error) {
+	user := User{}
+	var times nullTimestamps
+	err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Inactive, &user.Admin,
+		&user.SessionVersion, &times[0], &times[1], &times[2], &user.Vetoes,
+		&user.VotesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	user.Timestamps = times.timestamps()
+	return &user, nil
+}
+
+// UpdateUser updates user information. Passwords are changed with
+// ChangePassword and ResetPassword instead.
 func (s *Store) UpdateUser(updatedUser *User) error {
+	s, end := s.trace("UpdateUser")
+	defer end()
+
+	if updatedUser.Password != "" {
+		return NewServerError(http.StatusBadRequest,
+			"password can't be changed here, use /api/password")
+	}
+
 	user, err := s.GetUserByID(updatedUser.ID)
 	if err != nil {
-		slog.Error("error updating user", "error", err.Error())
+		s.log.Error("error updating user", "error", err.Error())
 		return ErrNotFound
 	}
 
 	if user.Name != updatedUser.Name {
+		if err := checkUserName(updatedUser.Name); err != nil {
+			return err
+		}
+
 		// make sure new name doesn't already exist
 		if s.usernameExists(updatedUser.Name) {
-			slog.Error("error updating user: name already exists", "name", updatedUser.Name)
+			s.log.Error("error updating user: name already exists", "name", updatedUser.Name)
 			return ErrConflict
 		}
 	}
 
-	var result sql.Result
-	if updatedUser.Password != "" {
-		pwd, err := bcrypt.GenerateFromPassword([]byte(updatedUser.Password), bcrypt.DefaultCost)
-		if err != nil {
-			slog.Error("error encrypting password", "error", err.Error())
-			return NewServerError(http.StatusInternalServerError, err.Error())
-		}
-
-		result, err = s.db.Exec(
-			`UPDATE users
-			 SET name = $1, password = $2, inactive = $3, vetoes = $4
-			 WHERE id = $5`,
-			updatedUser.Name, pwd, updatedUser.Inactive, updatedUser.Vetoes, updatedUser.ID,
-		)
-		if err != nil {
-			return NewServerError(http.StatusInternalServerError, err.Error())
-		}
-	} else {
-		result, err = s.db.Exec(
-			`UPDATE users
-			 SET name = $1, inactive = $2, vetoes = $3
-			 WHERE id = $4`,
-			updatedUser.Name, updatedUser.Inactive, updatedUser.Vetoes, updatedUser.ID,
-		)
-		if err != nil {
-			return NewServerError(http.StatusInternalServerError, err.Error())
-		}
+	result, err := s.db.Exec(
+		`UPDATE users
+		 SET name = $1, inactive = $2, updated_at = $3
+		 WHERE id = $4`,
+		updatedUser.Name, updatedUser.Inactive, time.Now().UTC(), updatedUser.ID,
+	)
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		slog.Error("error updating user: no rows affected")
+		s.log.Error("error updating user: no rows affected")
 		return ErrNotFound
 	}
 
-	slog.Info("User updated successfully", "user", user.Name)
+	_, err = s.db.Exec(
+		"UPDATE group_members SET vetoes = $1 WHERE group_id = $2 AND user_id = $3",
+		updatedUser.Vetoes, defaultGroupID, updatedUser.ID)
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("User updated successfully", "user", user.Name)
 	return nil
 }
 
 // DeleteUser performs a soft delete of the user with the given ID. The user
-// is marked as inactive, and is not included in user search results. Votes,
-// vetoes, and added songs by that user remain in the database.
+// is marked as inactive and deleted now, is not included in user search
+// results, and their sessions are revoked. Votes, vetoes, and added songs by
+// that user remain in the database.
 func (s *Store) DeleteUser(id int64) error {
-	result, err := s.db.Exec("UPDATE users SET inactive = $1 WHERE id = $2", true, id)
+	s, end := s.trace("DeleteUser")
+	defer end()
+
+	result, err := s.db.Exec(
+		`UPDATE users SET inactive = TRUE, updated_at = $1, deleted_at = $1
+		WHERE id = $2 AND deleted_at IS NULL`, time.Now().UTC(), id)
 	if err != nil {
-		slog.Error("error deleting user", "error", err.Error())
+		s.log.Error("error deleting user", "error", err.Error())
 		return NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
@@ -187,7 +316,7 @@ func (s *Store) DeleteUser(id int64) error {
 		return ErrNotFound
 	}
 
-	return nil
+	return s.RevokeSessions(id, 0)
 }
 
 // usernameExists returns true if a user with the given name is in the database.
@@ -208,16 +337,62 @@ func (s *Store) userIDExists(id int64) bool {
 	return err == nil
 }
 
-// CreateSong creates a new user with the given request data.
+// CreateSong adds a song to the current round of a group, with its
+// submitter's vote. The duplicate and quota checks, the insert and the vote
+// run in one transaction, so concurrent submissions can't exceed the quota
+// and a song is never left without its submitter's vote.
 func (s *Store) CreateSong(req NewSongRequest) (int64, error) {
-	if s.songTitleArtistExists(req.Title, req.Artist) {
+	s, end := s.trace("CreateSong")
+	defer end()
+
+	if req.GroupID == 0 {
+		req.GroupID = defaultGroupID
+	}
+
+	if _, err := s.GetMember(req.GroupID, req.AddedBy); err != nil {
+		return 0, err
+	}
+
+	group, err := s.GetGroupByID(req.GroupID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	if s.songTitleArtistExists(tx, req.GroupID, req.Title, req.Artist) {
 		return 0, ErrConflict
 	}
 
-	result, err := s.db.Exec(
-		`INSERT INTO songs(title, artist, link_url, votes, vetoed, added_by) 
-		VALUES($1, $2, $3, $4, $5, $6)`,
-		req.Title, req.Artist, req.LinkURL, 0, false, req.AddedBy,
+	var roundID int64
+	row := tx.QueryRow(
+		"SELECT id FROM rounds WHERE group_id = $1 AND closed = FALSE ORDER BY id DESC LIMIT 1",
+		req.GroupID)
+	if err := row.Scan(&roundID); err != nil {
+		return 0, ErrNotFound
+	}
+
+	// Check the user hasn't used up their song quota for the round.
+	added, err := s.songsAdded(tx, roundID, req.AddedBy)
+	if err != nil {
+		return 0, err
+	}
+
+	if added >= group.SongQuota {
+		return 0, NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("song quota of %d per round reached", group.SongQuota))
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO songs(title, artist, link_url, votes, vetoed, added_by, round_id, group_id,
+			created_at, updated_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)`,
+		req.Title, req.Artist, req.LinkURL, 0, false, req.AddedBy, roundID, req.GroupID,
+		time.Now().UTC(),
 	)
 	if err != nil {
 		return 0, NewServerError(http.StatusInternalServerError, err.Error())
@@ -225,63 +400,137 @@ func (s *Store) CreateSong(req NewSongRequest) (int64, error) {
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return id, NewServerError(http.StatusInternalServerError, err.Error())
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
-	slog.Info("New song created", "id", id, "title", req.Title, "artist", req.Artist)
-
-	voteReq := VoteRequest{SongID: id, UserID: req.AddedBy}
-	_, err = s.VoteForSong(voteReq)
+	// The submitter's vote for the song comes out of their budget.
+	voteID, err := s.castVote(tx, req.GroupID, id, req.AddedBy)
 	if err != nil {
-		return id, err
+		return 0, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	songsAdded.inc()
+	votesCast.inc()
+	s.log.Info("New song created", "id", id, "title", req.Title, "artist", req.Artist)
+	s.log.Info("New vote created", "id", voteID, "song_id", id, "user_id", req.AddedBy)
 	return id, nil
 }
 
 // GetSongByID returns song data that matches the given ID.
 func (s *Store) GetSongByID(id int64) (*Song, error) {
-	song := Song{}
+	s, end := s.trace("GetSongByID")
+	defer end()
 
-	row := s.db.QueryRow("SELECT * FROM songs WHERE id = $1", id)
-	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.LinkURL,
-		&song.Votes, &song.Vetoed, &song.AddedBy)
+	row := s.db.QueryRow("SELECT "+songColumns+" FROM songs WHERE id = $1", id)
+	song, err := scanSong(row)
 	if err != nil {
-		slog.Error("error retreiving song", "error", err)
+		s.log.Error("error retreiving song", "error", err)
 		return nil, ErrNotFound
 	}
 
-	return &song, nil
+	return song, nil
 }
 
-// GetSongs returns all songs in the database.
-func (s *Store) GetSongs() ([]*Song, error) {
+// GetSongs returns all songs of a group added in the given time range.
+func (s *Store) GetSongs(groupID int64, created TimeRange) ([]*Song, error) {
+	s, end := s.trace("GetSongs")
+	defer end()
+
 	songs := []*Song{}
 
-	rows, err := s.db.Query("SELECT * FROM songs")
+	condition, args := created.condition("songs.created_at", []any{groupID})
+	rows, err := s.db.Query(
+		"SELECT "+songColumns+" FROM songs WHERE group_id = $1 AND "+condition, args...)
 	if err != nil {
-		slog.Error("error getting songs from db", "error", err)
+		s.log.Error("error getting songs from db", "error", err)
 		return nil, err
 	}
 
 	for rows.Next() {
-		song := Song{}
-		err := rows.Scan(&song.ID, &song.Title, &song.Artist, &song.LinkURL,
-			&song.Votes, &song.Vetoed, &song.AddedBy)
+		song, err := scanSong(rows)
 		if err != nil {
-			slog.Error("error scanning rows", "error", err)
+			s.log.Error("error scanning rows", "error", err)
+			continue
 		}
-		songs = append(songs, &song)
+		songs = append(songs, song)
 	}
 
 	return songs, nil
 }
 
-// songTitleArtistExists checks whether a title/artist combination already exists.
-func (s *Store) songTitleArtistExists(title, artist string) bool {
+// songColumns lists the songs table columns in the order scanSong expects.
+const songColumns = `songs.id, songs.title, songs.artist, songs.link_url, songs.votes,
+	songs.vetoed, songs.added_by, COALESCE(songs.round_id, 0), songs.group_id,
+	songs.created_at, songs.updated_at, songs.deleted_at`
+
+// scanner is implemented by *timedRow and *timedRows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// execer is implemented by *timedDB and *timedTx, for statements that are run
+// on their own or as part of a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *timedRow
+}
+
+// scanSong reads a song selected with songColumns.
+func scanSong(row scanner) (*Song, error) {
+	song := Song{}
+	var times nullTimestamps
+	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.LinkURL,
+		&song.Votes, &song.Vetoed, &song.AddedBy, &song.RoundID, &song.GroupID,
+		&times[0], &times[1], &times[2])
+	if err != nil {
+		return nil, err
+	}
+	song.Timestamps = times.timestamps()
+	return &song, nil
+}
+
+// nullTimestamps scans the created_at, updated_at and deleted_at columns of a
+// row, in that order.
+type nullTimestamps [3]sql.NullTime
+
+// timestamps returns the scanned timestamps.
+func (t nullTimestamps) timestamps() Timestamps {
+	times := [3]*time.Time{}
+	for i := range t {
+		if t[i].Valid {
+			times[i] = &t[i].Time
+		}
+	}
+	return Timestamps{CreatedAt: times[0], UpdatedAt: times[1], DeletedAt: times[2]}
+}
+
+// condition returns an SQL condition selecting values of column in the time
+// range, and args with the bounds of the range appended. Placeholders are
+// numbered after the args already given.
+func (tr TimeRange) condition(column string, args []any) (string, []any) {
+	conditions := []string{"TRUE"}
+	if !tr.Since.IsZero() {
+		args = append(args, tr.Since.UTC())
+		conditions = append(conditions, fmt.Sprintf("%s >= $%d", column, len(args)))
+	}
+	if !tr.Until.IsZero() {
+		args = append(args, tr.Until.UTC())
+		conditions = append(conditions, fmt.Sprintf("%s < $%d", column, len(args)))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// songTitleArtistExists checks whether a title/artist combination already
+// exists in a group.
+func (s *Store) songTitleArtistExists(db execer, groupID int64, title, artist string) bool {
 	var id int64
-	row := s.db.QueryRow("SELECT id FROM songs WHERE title = $1 AND artist = $2",
-		title, artist)
+	row := db.QueryRow(
+		"SELECT id FROM songs WHERE group_id = $1 AND title = $2 AND artist = $3",
+		groupID, title, artist)
 	err := row.Scan(&id)
 	return err == nil
 }
@@ -294,168 +543,306 @@ func (s *Store) songIDExists(id int64) bool {
 	return err == nil
 }
 
-// GetVotesBySongID returns a slice of votes for the given song ID.
+// GetVotesBySongID returns a slice of the votes for the given song ID that
+// weren't retracted.
 func (s *Store) GetVotesBySongID(songID int64) ([]Vote, error) {
+	s, end := s.trace("GetVotesBySongID")
+	defer end()
+
 	votes := []Vote{}
-	rows, err := s.db.Query("SELECT * FROM votes WHERE song_id = $1", songID)
+	rows, err := s.db.Query(
+		`SELECT id, song_id, user_id, created_at, updated_at, deleted_at FROM votes
+		WHERE song_id = $1 AND deleted_at IS NULL`, songID)
 	if err != nil {
-		slog.Error("error querying votes", "error", err)
+		s.log.Error("error querying votes", "error", err)
 		return nil, fmt.Errorf("error querying votes: %v", err)
 	}
 
 	for rows.Next() {
 		vote := Vote{}
-		err := rows.Scan(&vote.ID, &vote.SongID, &vote.UserID)
+		var times nullTimestamps
+		err := rows.Scan(&vote.ID, &vote.SongID, &vote.UserID, &times[0], &times[1], &times[2])
 		if err != nil {
-			slog.Error("Error scanning rows", "error", err)
+			s.log.Error("Error scanning rows", "error", err)
 			return nil, fmt.Errorf("error scanning rows: %v", err)
 		}
+		vote.Timestamps = times.timestamps()
 		votes = append(votes, vote)
 	}
 
 	return votes, nil
 }
 
-// VoteForSong adds a vote to a song.
+// VoteForSong adds a user's vote to a song in the current round and spends one
+// of the user's votes in the song's group. The vote is recorded and spent in
+// one transaction that fails if the user has already voted for the song or
+// has no votes left, so concurrent votes can't vote twice or overspend.
 func (s *Store) VoteForSong(req VoteRequest) (int64, error) {
+	s, end := s.trace("VoteForSong")
+	defer end()
+
 	// Validate input.
 	if req.SongID < 1 || req.UserID < 1 {
-		return 0, fmt.Errorf("invalid song/user ID")
+		return 0, NewServerError(http.StatusBadRequest, "invalid song/user ID")
 	}
 
 	if !s.userIDExists(req.UserID) {
-		return 0, fmt.Errorf("user %d not found", req.UserID)
+		return 0, ErrNotFound
 	}
 
-	if !s.songIDExists(req.SongID) {
-		return 0, fmt.Errorf("song %d not found", req.SongID)
+	// Check the song is in the current round of one of the user's groups.
+	song, err := s.checkSongInCurrentRound(req.SongID)
+	if err != nil {
+		return 0, err
 	}
 
-	// Get existing votes for the song.
-	votes, err := s.GetVotesBySongID(req.SongID)
-	if err != nil {
-		slog.Error("error getting votes", "error", err)
-		return 0, fmt.Errorf("error getting votes: %v", err)
+	if _, err := s.getSongMember(song, req.UserID); err != nil {
+		return 0, err
 	}
 
-	// Check if user has already voted for the song.
-	for _, vote := range votes {
-		if vote.SongID == req.SongID && vote.UserID == req.UserID {
-			return 0, fmt.Errorf("user has already voted for this song")
-		}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
+	defer tx.Rollback()
 
-	// Create the new vote record.
-	id, err := s.createVote(req)
+	id, err := s.castVote(tx, song.GroupID, req.SongID, req.UserID)
 	if err != nil {
 		return 0, err
 	}
-	slog.Info("New vote created", "id", id, "song_id", req.SongID, "user_id", req.UserID)
 
-	// Update vote count on the song.
-	_, err = s.db.Exec("UPDATE songs SET votes = $1 WHERE id = $2",
-		len(votes)+1, req.SongID)
-	if err != nil {
-		slog.Error("error updating vote count", "error", err)
-		return id, fmt.Errorf("error updating vote count: %v", err)
+	if err := tx.Commit(); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
+	votesCast.inc()
+	s.log.Info("New vote created", "id", id, "song_id", req.SongID, "user_id", req.UserID)
 	return id, nil
 }
 
-// createVote adds a vote record to the database.
-func (s *Store) createVote(req VoteRequest) (int64, error) {
-	result, err := s.db.Exec("INSERT INTO votes(song_id, user_id) VALUES($1, $2)",
-		req.SongID, req.UserID)
+// castVote records a user's vote for a song and spends one of the user's votes
+// in the song's group, as part of a transaction. It fails if the user has
+// already voted for the song or has no votes left.
+func (s *Store) castVote(tx *timedTx, groupID, songID, userID int64) (int64, error) {
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		`INSERT INTO votes(song_id, user_id, created_at, updated_at)
+		SELECT $1, $2, $3, $3
+		WHERE NOT EXISTS (
+			SELECT 1 FROM votes WHERE song_id = $1 AND user_id = $2 AND deleted_at IS NULL)`,
+		songID, userID, now)
 	if err != nil {
-		slog.Error("Error recording vote", "error", err)
-		return 0, fmt.Errorf("error recording vote: %v", err)
+		s.log.Error("error recording vote", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, NewServerError(http.StatusConflict, "user has already voted for this song")
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		slog.Error("error retreiving vote id", "error", err)
-		return id, fmt.Errorf("error retreiving vote id: %v", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	result, err = tx.Exec(
+		`UPDATE group_members SET votes_remaining = votes_remaining - 1
+		WHERE group_id = $1 AND user_id = $2 AND votes_remaining > 0`,
+		groupID, userID)
+	if err != nil {
+		s.log.Error("error updating user votes remaining", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, NewServerError(http.StatusBadRequest, "no votes remaining")
+	}
+
+	_, err = tx.Exec("UPDATE songs SET votes = votes + 1, updated_at = $1 WHERE id = $2",
+		now, songID)
+	if err != nil {
+		s.log.Error("error updating vote count", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
 	return id, nil
 }
 
-// VetoSong adds a veto for a song.
-func (s *Store) VetoSong(req VetoRequest) (int64, error) {
-	// Validate input.
-	if req.SongID < 1 || req.UserID < 1 {
-		return 0, fmt.Errorf("invalid song/user ID")
+// RetractVote soft deletes a user's vote for a song in the current round and
+// refunds it to the user, in one transaction.
+func (s *Store) RetractVote(req VoteRequest) error {
+	s, end := s.trace("RetractVote")
+	defer end()
+
+	song, err := s.checkSongInCurrentRound(req.SongID)
+	if err != nil {
+		return err
 	}
 
-	if !s.userIDExists(req.UserID) {
-		return 0, fmt.Errorf("user %d not found", req.UserID)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
 	}
+	defer tx.Rollback()
 
-	if !s.songIDExists(req.SongID) {
-		return 0, fmt.Errorf("song %d not found", req.SongID)
+	var id int64
+	now := time.Now().UTC()
+	row := tx.QueryRow(
+		`UPDATE votes SET updated_at = $1, deleted_at = $1
+		WHERE song_id = $2 AND user_id = $3 AND deleted_at IS NULL
+		RETURNING id`, now, req.SongID, req.UserID)
+	if err := row.Scan(&id); err != nil {
+		return NewServerError(http.StatusNotFound,
+			fmt.Sprintf("user %d has not voted for song %d", req.UserID, req.SongID))
 	}
 
-	// Check if song is already vetoed.
-	song, err := s.GetSongByID(req.SongID)
+	_, err = tx.Exec("UPDATE songs SET votes = votes - 1, updated_at = $1 WHERE id = $2",
+		now, req.SongID)
 	if err != nil {
-		return 0, err
+		s.log.Error("error updating vote count", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
-	if song.Vetoed {
-		return 0, fmt.Errorf("song %d is already vetoed", req.SongID)
+	_, err = tx.Exec(
+		`UPDATE group_members SET votes_remaining = votes_remaining + 1
+		WHERE group_id = $1 AND user_id = $2`,
+		song.GroupID, req.UserID)
+	if err != nil {
+		s.log.Error("error refunding vote", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
-	// Check if user has vetoes remaining.
-	user, err := s.GetUserByID(req.UserID)
+	s.log.Info("Vote retracted", "id", id, "song_id", req.SongID, "user_id", req.UserID)
+	return nil
+}
+
+// checkSongInCurrentRound returns the song with the given ID, or an error if
+// it doesn't belong to the open round of its group.
+func (s *Store) checkSongInCurrentRound(songID int64) (*Song, error) {
+	song, err := s.GetSongByID(songID)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	round, err := s.GetCurrentRound(song.GroupID)
+	if err != nil {
+		return nil, err
 	}
 
-	if user.Vetoes == 0 {
-		return 0, fmt.Errorf("user %d doesn't have any vetoes remaining", req.UserID)
+	if song.RoundID != round.ID {
+		return nil, NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("song %d is not in the current round", songID))
 	}
 
-	// Add veto record.
-	id, err := s.createVeto(req)
+	return song, nil
+}
+
+// getSongMember returns the user's membership of the song's group, or an
+// error if they are not a member.
+func (s *Store) getSongMember(song *Song, userID int64) (*Member, error) {
+	member, err := s.GetMember(song.GroupID, userID)
 	if err != nil {
-		return id, err
+		return nil, NewServerError(http.StatusForbidden,
+			fmt.Sprintf("user %d is not a member of group %d", userID, song.GroupID))
+	}
+	return member, nil
+}
+
+// VetoSong records a user's veto of a song in the current round and spends
+// one of the user's vetoes in the song's group. The checks and writes run in
+// one transaction, so concurrent vetoes can't veto a song twice or spend more
+// vetoes than the user has.
+func (s *Store) VetoSong(req VetoRequest) (int64, error) {
+	s, end := s.trace("VetoSong")
+	defer end()
+
+	// Validate input.
+	if req.SongID < 1 || req.UserID < 1 {
+		return 0, NewServerError(http.StatusBadRequest, "invalid song/user ID")
+	}
+
+	if !s.userIDExists(req.UserID) {
+		return 0, ErrNotFound
 	}
-	slog.Info("New veto created", "id", id, "song_id", req.SongID, "user_id", req.UserID)
 
-	// Update veto flag of song.
-	_, err = s.db.Exec("UPDATE songs SET vetoed = $1 WHERE id = $2",
-		true, req.SongID)
+	song, err := s.checkSongInCurrentRound(req.SongID)
 	if err != nil {
-		slog.Error("error updating veto field of song", "error", err)
-		return id, fmt.Errorf("error updating veto field of song: %v", err)
+		return 0, err
+	}
+
+	if _, err := s.getSongMember(song, req.UserID); err != nil {
+		return 0, err
 	}
 
-	// Update veto count of user.
-	_, err = s.db.Exec("UPDATE users SET vetoes = $1 WHERE id = $2",
-		user.Vetoes-1, req.UserID)
+	tx, err := s.db.Begin()
 	if err != nil {
-		slog.Error("error updating user veto count", "error", err)
-		return id, fmt.Errorf("error updating user veto count: %v", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
+	defer tx.Rollback()
 
-	return id, nil
-}
+	// A veto the group overrode can't be replaced by another one.
+	var vetoed, overridden bool
+	row := tx.QueryRow(
+		`SELECT vetoed, EXISTS (SELECT 1 FROM vetoes WHERE song_id = $1 AND overridden = TRUE)
+		FROM songs WHERE id = $1`, req.SongID)
+	if err := row.Scan(&vetoed, &overridden); err != nil {
+		s.log.Error("error checking song vetoes", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if vetoed {
+		return 0, NewServerError(http.StatusConflict,
+			fmt.Sprintf("song %d is already vetoed", req.SongID))
+	}
 
-// createVeto adds a veto record to the database.
-func (s *Store) createVeto(req VetoRequest) (int64, error) {
-	result, err := s.db.Exec("INSERT INTO vetoes(song_id, user_id) VALUES($1, $2)",
-		req.SongID, req.UserID)
+	if overridden {
+		return 0, NewServerError(http.StatusConflict,
+			fmt.Sprintf("veto of song %d was overridden", req.SongID))
+	}
+
+	// Spend one of the user's vetoes in the song's group.
+	result, err := tx.Exec(
+		`UPDATE group_members SET vetoes = vetoes - 1
+		WHERE group_id = $1 AND user_id = $2 AND vetoes > 0`,
+		song.GroupID, req.UserID)
 	if err != nil {
-		slog.Error("Error recording veto", "error", err)
-		return 0, fmt.Errorf("error recording veto: %v", err)
+		s.log.Error("error updating user veto count", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("user %d doesn't have any vetoes remaining", req.UserID))
+	}
+
+	now := time.Now().UTC()
+	result, err = tx.Exec(
+		`INSERT INTO vetoes(song_id, user_id, overridden, created_at, updated_at)
+		VALUES($1, $2, $3, $4, $4)`,
+		req.SongID, req.UserID, false, now)
+	if err != nil {
+		s.log.Error("error recording veto", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		slog.Error("error retreiving veto id", "error", err)
-		return id, fmt.Errorf("error retreiving veto id: %v", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	_, err = tx.Exec("UPDATE songs SET vetoed = TRUE, updated_at = $1 WHERE id = $2",
+		now, req.SongID)
+	if err != nil {
+		s.log.Error("error updating veto field of song", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
 	}
 
+	vetoesCast.inc()
+	s.log.Info("New veto created", "id", id, "song_id", req.SongID, "user_id", req.UserID)
 	return id, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LogAudit appends an entry to the audit log.
+func (s *Store) LogAudit(entry AuditEntry) error {
+	s, end := s.trace("LogAudit")
+	defer end()
+
+	return s.logAudit(s.db, entry)
+}
+
+// logAudit writes an entry to the audit log with db, which can be the
+// transaction of the change being audited.
+func (s *Store) logAudit(db execer, entry AuditEntry) error {
+	_, err := db.Exec(
+		`INSERT INTO audit_log(created_at, actor_id, action, target_type, target_id, before,
+			after, request_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		time.Now().UTC(), entry.ActorID, entry.Action, entry.TargetType, entry.TargetID,
+		nullJSON(entry.Before), nullJSON(entry.After), entry.RequestID)
+	if err != nil {
+		s.log.Error("error writing audit log", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+// GetAuditLog returns the audit entries matching the filter, newest first.
+func (s *Store) GetAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	s, end := s.trace("GetAuditLog")
+	defer end()
+
+	entries := []AuditEntry{}
+
+	if filter.Limit < 0 {
+		return nil, NewServerError(http.StatusBadRequest, "limit can't be negative")
+	}
+	if filter.Limit == 0 {
+		filter.Limit = auditPageSize
+	}
+	filter.Limit = min(filter.Limit, auditMaxPageSize)
+
+	conditions := []string{"TRUE"}
+	args := []any{}
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.ActorID != 0 {
+		where("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		where("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		where("target_id = $%d", filter.TargetID)
+	}
+	var created string
+	created, args = filter.TimeRange.condition("created_at", args)
+	conditions = append(conditions, created)
+	args = append(args, filter.Limit)
+
+	rows, err := s.db.Query(
+		`SELECT id, created_at, actor_id, action, target_type, target_id, before, after,
+			request_id
+		FROM audit_log
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY id DESC
+		LIMIT $`+fmt.Sprint(len(args)), args...)
+	if err != nil {
+		s.log.Error("error getting audit log from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := AuditEntry{}
+		var before, after []byte
+		err := rows.Scan(&entry.ID, &entry.CreatedAt, &entry.ActorID, &entry.Action,
+			&entry.TargetType, &entry.TargetID, &before, &after, &entry.RequestID)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		entry.Before, entry.After = before, after
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// nullJSON returns the JSON text to store for a snapshot, or nil for none.
+func nullJSON(snapshot []byte) any {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	return string(snapshot)
+}
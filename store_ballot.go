@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SubmitBallot records a user's ordered choices for the current round of a
+// group, replacing any ballot they submitted before. Rounds using approval
+// voting take votes instead of ballots.
+func (s *Store) SubmitBallot(req BallotRequest) (*Ballot, error) {
+	s, end := s.trace("SubmitBallot")
+	defer end()
+
+	if req.GroupID == 0 {
+		req.GroupID = defaultGroupID
+	}
+
+	if _, err := s.GetMember(req.GroupID, req.UserID); err != nil {
+		return nil, err
+	}
+
+	round, err := s.GetCurrentRound(req.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if round.VotingMethod == MethodApproval {
+		return nil, NewServerError(http.StatusBadRequest,
+			"round uses approval voting, vote for songs instead")
+	}
+
+	if round.VotingMethod == MethodLimited && len(req.Choices) > round.VoteBudget {
+		return nil, NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("ballot can name at most %d songs", round.VoteBudget))
+	}
+
+	candidates, err := s.getRoundCandidates(round.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(validChoices(candidates, req.Choices)) != len(req.Choices) {
+		return nil, NewServerError(http.StatusBadRequest,
+			"ballot must name distinct songs from the current round that are not vetoed")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM ballots WHERE round_id = $1 AND user_id = $2",
+		round.ID, req.UserID)
+	if err != nil {
+		s.log.Error("error clearing ballot", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	for i, songID := range req.Choices {
+		_, err := tx.Exec(
+			`INSERT INTO ballots(round_id, user_id, song_id, rank) VALUES($1, $2, $3, $4)`,
+			round.ID, req.UserID, songID, i+1)
+		if err != nil {
+			s.log.Error("error recording ballot", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Ballot submitted", "round_id", round.ID, "user_id", req.UserID,
+		"choices", len(req.Choices))
+	return &Ballot{UserID: req.UserID, Choices: req.Choices}, nil
+}
+
+// GetBallots returns the ballots submitted in the given round.
+func (s *Store) GetBallots(roundID int64) ([]Ballot, error) {
+	s, end := s.trace("GetBallots")
+	defer end()
+
+	return s.getBallots(
+		`SELECT user_id, song_id FROM ballots
+		WHERE round_id = $1
+		ORDER BY user_id, rank`, roundID)
+}
+
+// getApprovalBallots returns the votes cast for songs in the given round as
+// one ballot per user.
+func (s *Store) getApprovalBallots(roundID int64) ([]Ballot, error) {
+	return s.getBallots(
+		`SELECT votes.user_id, votes.song_id
+		FROM votes JOIN songs ON songs.id = votes.song_id
+		WHERE songs.round_id = $1 AND votes.deleted_at IS NULL
+		ORDER BY votes.user_id, votes.id`, roundID)
+}
+
+// getBallots groups the user ID and song ID rows returned by query into
+// ballots. Rows must be ordered by user.
+func (s *Store) getBallots(query string, roundID int64) ([]Ballot, error) {
+	ballots := []Ballot{}
+
+	rows, err := s.db.Query(query, roundID)
+	if err != nil {
+		s.log.Error("error getting ballots", "round_id", roundID, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, songID int64
+		if err := rows.Scan(&userID, &songID); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+
+		if len(ballots) == 0 || ballots[len(ballots)-1].UserID != userID {
+			ballots = append(ballots, Ballot{UserID: userID})
+		}
+		last := &ballots[len(ballots)-1]
+		last.Choices = append(last.Choices, songID)
+	}
+
+	return ballots, nil
+}
+
+// getRoundCandidates returns the IDs of the songs in the given round that
+// are not vetoed, in the order they were added.
+func (s *Store) getRoundCandidates(roundID int64) ([]int64, error) {
+	candidates := []int64{}
+
+	rows, err := s.db.Query(
+		"SELECT id FROM songs WHERE round_id = $1 AND vetoed = FALSE ORDER BY id", roundID)
+	if err != nil {
+		s.log.Error("error getting round songs", "round_id", roundID, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		candidates = append(candidates, id)
+	}
+
+	return candidates, nil
+}
+
+// TallyRound counts the ballots of the given round with the round's voting
+// method. Vetoed songs are not candidates.
+func (s *Store) TallyRound(roundID int64) (*TallyResult, error) {
+	s, end := s.trace("TallyRound")
+	defer end()
+
+	round, err := s.GetRoundByID(roundID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.getRoundCandidates(round.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ballots []Ballot
+	if round.VotingMethod == MethodApproval {
+		ballots, err = s.getApprovalBallots(round.ID)
+	} else {
+		ballots, err = s.GetBallots(round.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := Tally(round.VotingMethod, candidates, ballots, round.VoteBudget)
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	result.RoundID = round.ID
+
+	return result, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExportUser returns all the data kept about the user with the given ID.
+func (s *Store) ExportUser(userID int64) (*UserExport, error) {
+	s, end := s.trace("ExportUser")
+	defer end()
+
+	// Deleted users can still take their data with them, but nothing is left
+	// of erased users to export.
+	user, err := s.getUserByID(userID)
+	if err != nil || user.Name == erasedUserName(userID) {
+		return nil, ErrNotFound
+	}
+	user.Password = ""
+
+	export := UserExport{ExportedAt: time.Now().UTC(), User: *user}
+
+	if export.Groups, err = s.getMemberships(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Songs, err = s.getSongsAddedBy(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Votes, err = s.getUserVotes(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Vetoes, err = s.getUserVetoes(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Ballots, err = s.getUserBallots(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Overrides, err = s.getUserOverrides(userID); err != nil {
+		return nil, err
+	}
+
+	if export.Sessions, err = s.GetSessions(userID); err != nil {
+		return nil, err
+	}
+
+	if export.APITokens, err = s.GetAPITokens(userID); err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+// getSongsAddedBy returns the songs a user added in all groups.
+func (s *Store) getSongsAddedBy(userID int64) ([]Song, error) {
+	songs := []Song{}
+
+	rows, err := s.db.Query(
+		"SELECT "+songColumns+" FROM songs WHERE added_by = $1 ORDER BY id", userID)
+	if err != nil {
+		s.log.Error("error getting songs from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		songs = append(songs, *song)
+	}
+
+	return songs, nil
+}
+
+// getUserVotes returns the votes a user cast, including retracted ones.
+func (s *Store) getUserVotes(userID int64) ([]Vote, error) {
+	votes := []Vote{}
+
+	err := s.queryUserRows(
+		`SELECT id, song_id, user_id, created_at, updated_at, deleted_at FROM votes
+		WHERE user_id = $1 ORDER BY id`, userID,
+		func(row scanner) error {
+			vote := Vote{}
+			var times nullTimestamps
+			err := row.Scan(&vote.ID, &vote.SongID, &vote.UserID, &times[0], &times[1], &times[2])
+			vote.Timestamps = times.timestamps()
+			votes = append(votes, vote)
+			return err
+		})
+
+	return votes, err
+}
+
+// getUserVetoes returns the vetoes a user cast.
+func (s *Store) getUserVetoes(userID int64) ([]Veto, error) {
+	vetoes := []Veto{}
+
+	err := s.queryUserRows(
+		`SELECT id, song_id, user_id, created_at, updated_at, deleted_at FROM vetoes
+		WHERE user_id = $1 ORDER BY id`, userID,
+		func(row scanner) error {
+			veto := Veto{}
+			var times nullTimestamps
+			err := row.Scan(&veto.ID, &veto.SongID, &veto.UserID, &times[0], &times[1], &times[2])
+			veto.Timestamps = times.timestamps()
+			vetoes = append(vetoes, veto)
+			return err
+		})
+
+	return vetoes, err
+}
+
+// getUserBallots returns the ballots a user submitted, one per round.
+func (s *Store) getUserBallots(userID int64) ([]RoundBallot, error) {
+	ballots := []RoundBallot{}
+
+	err := s.queryUserRows(
+		`SELECT round_id, song_id FROM ballots
+		WHERE user_id = $1 ORDER BY round_id, rank`, userID,
+		func(row scanner) error {
+			var roundID, songID int64
+			if err := row.Scan(&roundID, &songID); err != nil {
+				return err
+			}
+			if len(ballots) == 0 || ballots[len(ballots)-1].RoundID != roundID {
+				ballots = append(ballots, RoundBallot{RoundID: roundID})
+			}
+			last := &ballots[len(ballots)-1]
+			last.Choices = append(last.Choices, songID)
+			return nil
+		})
+
+	return ballots, err
+}
+
+// getUserOverrides returns the votes a user cast to lift vetoes.
+func (s *Store) getUserOverrides(userID int64) ([]Override, error) {
+	overrides := []Override{}
+
+	err := s.queryUserRows(
+		`SELECT id, song_id, user_id FROM overrides
+		WHERE user_id = $1 ORDER BY id`, userID,
+		func(row scanner) error {
+			override := Override{}
+			err := row.Scan(&override.ID, &override.SongID, &override.UserID)
+			overrides = append(overrides, override)
+			return err
+		})
+
+	return overrides, err
+}
+
+// queryUserRows runs a query for the rows of a user and calls scan for each
+// of them.
+func (s *Store) queryUserRows(query string, userID int64, scan func(scanner) error) error {
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		s.log.Error("error getting user data from db", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return NewServerError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// EraseUser removes the personal data of the user with the given ID, whether
+// or not they were deleted before. The user row is kept so songs, votes and
+// vetoes keep their counts and references, but is renamed and can't log in.
+// Sessions, API tokens, linked identities, password resets and failed logins
+// of the user are deleted, and user snapshots in the audit log are redacted,
+// the one change the otherwise append-only log allows.
+func (s *Store) EraseUser(userID int64) error {
+	s, end := s.trace("EraseUser")
+	defer end()
+
+	var name string
+	row := s.db.QueryRow("SELECT name FROM users WHERE id = $1", userID)
+	if err := row.Scan(&name); err != nil {
+		return ErrNotFound
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`UPDATE users SET name = $1, password = '', inactive = TRUE, admin = FALSE,
+			session_version = session_version + 1, updated_at = $2,
+			deleted_at = COALESCE(deleted_at, $2)
+		WHERE id = $3`, []any{erasedUserName(userID), now, userID}},
+		{"DELETE FROM user_sessions WHERE user_id = $1", []any{userID}},
+		{"DELETE FROM api_tokens WHERE user_id = $1", []any{userID}},
+		{"DELETE FROM user_identities WHERE user_id = $1", []any{userID}},
+		{"DELETE FROM password_resets WHERE user_id = $1", []any{userID}},
+		{`DELETE FROM login_failures
+		WHERE (kind = $1 AND key = $2) OR (kind = $3 AND substr(key, instr(key, ' ') + 1) = $2)`,
+			[]any{loginKindUser, name, loginKindUserIP}},
+		{"UPDATE audit_log SET before = NULL, after = NULL WHERE target_type = $1 AND target_id = $2",
+			[]any{AuditTargetUser, userID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			s.log.Error("error erasing user", "id", userID, "error", err)
+			return NewServerError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("User erased", "id", userID)
+	return nil
+}
+
+// erasedUserPrefix starts the names erased users are renamed to. Other users
+// can't take names starting with it, so the names can't collide.
+const erasedUserPrefix = "Deleted user "
+
+// erasedUserName returns the name an erased user is renamed to.
+func erasedUserName(userID int64) string {
+	return fmt.Sprintf("%s%d", erasedUserPrefix, userID)
+}
+
+// checkUserName returns an error if a user can't take the given name.
+func checkUserName(name string) error {
+	if strings.HasPrefix(name, erasedUserPrefix) {
+		return NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("user names starting with %q are reserved", erasedUserPrefix))
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// CreateGroup creates a new group with the given user as its owner.
+func (s *Store) CreateGroup(ownerID int64, req GroupRequest) (*Group, error) {
+	s, end := s.trace("CreateGroup")
+	defer end()
+
+	if req.Name == "" {
+		return nil, NewServerError(http.StatusBadRequest, "group name is required")
+	}
+
+	group := &Group{
+		Name:          req.Name,
+		VetoAllowance: initialVetoes,
+		SongQuota:     defaultSongQuota,
+		VotingMethod:  MethodApproval,
+	}
+	if err := applyGroupRequest(group, req); err != nil {
+		return nil, err
+	}
+
+	if !s.userIDExists(ownerID) {
+		return nil, ErrNotFound
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	group.InviteCode = code
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO groups(name, invite_code, veto_allowance, song_quota, voting_method)
+		VALUES($1, $2, $3, $4, $5)`,
+		group.Name, group.InviteCode, group.VetoAllowance, group.SongQuota, group.VotingMethod)
+	if err != nil {
+		s.log.Error("error creating group", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	group.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	// The group's first round is started with it, so there is always a
+	// current round to read.
+	result, err = tx.Exec(
+		`INSERT INTO rounds(group_id, closed, voting_method, vote_budget,
+			veto_override_fraction, veto_override_refund)
+		VALUES($1, FALSE, $2, $3, $4, FALSE)`,
+		group.ID, group.VotingMethod, defaultVoteBudget, defaultVetoOverrideFraction)
+	if err != nil {
+		s.log.Error("error creating round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	roundID, err := result.LastInsertId()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO group_members(group_id, user_id, role, vetoes, votes_remaining)
+		VALUES($1, $2, $3, $4, $5)`,
+		group.ID, ownerID, RoleOwner, group.VetoAllowance, defaultVoteBudget)
+	if err != nil {
+		s.log.Error("error adding group member", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("New group created", "id", group.ID, "name", group.Name, "owner", ownerID)
+	s.log.Info("New round started", "id", roundID, "group_id", group.ID,
+		"voting_method", group.VotingMethod, "vote_budget", defaultVoteBudget)
+	s.log.Info("User joined group", "group_id", group.ID, "user_id", ownerID, "role", RoleOwner)
+	return group, nil
+}
+
+// GetGroupByID returns the group with the given ID.
+func (s *Store) GetGroupByID(id int64) (*Group, error) {
+	s, end := s.trace("GetGroupByID")
+	defer end()
+
+	row := s.db.QueryRow("SELECT "+groupColumns+" FROM groups WHERE id = $1", id)
+	group, err := scanGroup(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return group, nil
+}
+
+// GetGroupsByUserID returns the groups the given user is a member of.
+func (s *Store) GetGroupsByUserID(userID int64) ([]Group, error) {
+	s, end := s.trace("GetGroupsByUserID")
+	defer end()
+
+	groups := []Group{}
+
+	rows, err := s.db.Query(
+		`SELECT `+groupColumns+` FROM groups
+		JOIN group_members ON group_members.group_id = groups.id
+		WHERE group_members.user_id = $1
+		ORDER BY groups.id`, userID)
+	if err != nil {
+		s.log.Error("error getting groups from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		groups = append(groups, *group)
+	}
+
+	return groups, nil
+}
+
+// UpdateGroup changes the name and settings of a group. New settings apply
+// from the group's next round, except the voting method, which also applies
+// to the current round.
+func (s *Store) UpdateGroup(id int64, req GroupRequest) (*Group, error) {
+	s, end := s.trace("UpdateGroup")
+	defer end()
+
+	group, err := s.GetGroupByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Name != "" {
+		group.Name = req.Name
+	}
+	if err := applyGroupRequest(group, req); err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(
+		`UPDATE groups SET name = $1, veto_allowance = $2, song_quota = $3, voting_method = $4
+		WHERE id = $5`,
+		group.Name, group.VetoAllowance, group.SongQuota, group.VotingMethod, id)
+	if err != nil {
+		s.log.Error("error updating group", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if req.VotingMethod != "" {
+		_, err := s.UpdateRound(id, RoundRequest{VotingMethod: req.VotingMethod})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.log.Info("Group updated", "id", id)
+	return group, nil
+}
+
+// applyGroupRequest copies the settings in req to group, leaving the ones req
+// doesn't set unchanged.
+func applyGroupRequest(group *Group, req GroupRequest) error {
+	if req.VetoAllowance < 0 || req.SongQuota < 0 {
+		return NewServerError(http.StatusBadRequest,
+			"veto allowance and song quota can't be negative")
+	}
+
+	if req.VotingMethod != "" && !validVotingMethod(req.VotingMethod) {
+		return NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("unknown voting method %q", req.VotingMethod))
+	}
+
+	if req.VetoAllowance > 0 {
+		group.VetoAllowance = req.VetoAllowance
+	}
+	if req.SongQuota > 0 {
+		group.SongQuota = req.SongQuota
+	}
+	if req.VotingMethod != "" {
+		group.VotingMethod = req.VotingMethod
+	}
+
+	return nil
+}
+
+// JoinGroup adds the given user to the group with the given invite code.
+func (s *Store) JoinGroup(userID int64, inviteCode string) (*Member, error) {
+	s, end := s.trace("JoinGroup")
+	defer end()
+
+	var groupID int64
+	row := s.db.QueryRow("SELECT id FROM groups WHERE invite_code = $1", inviteCode)
+	if err := row.Scan(&groupID); err != nil {
+		return nil, NewServerError(http.StatusNotFound, "invalid invite code")
+	}
+
+	if _, err := s.GetMember(groupID, userID); err == nil {
+		return nil, ErrConflict
+	}
+
+	if err := s.addMember(s.db, groupID, userID, RoleMember); err != nil {
+		return nil, err
+	}
+
+	return s.GetMember(groupID, userID)
+}
+
+// addMember adds a user to a group with the group's veto allowance and the
+// vote budget of its current round, on its own or as part of a transaction.
+func (s *Store) addMember(db execer, groupID, userID int64, role string) error {
+	result, err := db.Exec(
+		`INSERT INTO group_members(group_id, user_id, role, vetoes, votes_remaining)
+		SELECT groups.id, $2, $3, groups.veto_allowance, rounds.vote_budget
+		FROM groups JOIN rounds ON rounds.group_id = groups.id AND rounds.closed = FALSE
+		WHERE groups.id = $1
+		ORDER BY rounds.id DESC LIMIT 1`,
+		groupID, userID, role)
+	if err != nil {
+		s.log.Error("error adding group member", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	s.log.Info("User joined group", "group_id", groupID, "user_id", userID, "role", role)
+	return nil
+}
+
+// GetMember returns the membership of an active user in a group.
+func (s *Store) GetMember(groupID, userID int64) (*Member, error) {
+	s, end := s.trace("GetMember")
+	defer end()
+
+	row := s.db.QueryRow(
+		`SELECT `+memberColumns+` FROM group_members
+		JOIN users ON users.id = group_members.user_id
+		WHERE group_members.group_id = $1 AND group_members.user_id = $2
+			AND users.inactive = FALSE`, groupID, userID)
+	member, err := scanMember(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return member, nil
+}
+
+// GetMembers returns the active members of a group.
+func (s *Store) GetMembers(groupID int64) ([]Member, error) {
+	s, end := s.trace("GetMembers")
+	defer end()
+
+	members := []Member{}
+
+	rows, err := s.db.Query(
+		`SELECT `+memberColumns+` FROM group_members
+		JOIN users ON users.id = group_members.user_id
+		WHERE group_members.group_id = $1 AND users.inactive = FALSE
+		ORDER BY users.name`, groupID)
+	if err != nil {
+		s.log.Error("error getting group members", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		member, err := scanMember(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		members = append(members, *member)
+	}
+
+	return members, nil
+}
+
+// countActiveMembers returns the number of active users in a group.
+func (s *Store) countActiveMembers(groupID int64) (int, error) {
+	var count int
+	row := s.db.QueryRow(
+		`SELECT COUNT(*) FROM group_members
+		JOIN users ON users.id = group_members.user_id
+		WHERE group_members.group_id = $1 AND users.inactive = FALSE`, groupID)
+	if err := row.Scan(&count); err != nil {
+		s.log.Error("error counting active members", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	return count, nil
+}
+
+// newInviteCode returns a random code for joining a group.
+func newInviteCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// groupColumns lists the groups table columns in the order scanGroup expects.
+const groupColumns = `groups.id, groups.name, groups.invite_code, groups.veto_allowance,
+	groups.song_quota, groups.voting_method`
+
+// scanGroup reads a group selected with groupColumns.
+func scanGroup(row scanner) (*Group, error) {
+	group := Group{}
+	err := row.Scan(&group.ID, &group.Name, &group.InviteCode, &group.VetoAllowance,
+		&group.SongQuota, &group.VotingMethod)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// memberColumns lists the group_members and users table columns in the order
+// scanMember expects.
+const memberColumns = `group_members.group_id, group_members.user_id, users.name,
+	group_members.role, group_members.vetoes, group_members.votes_remaining`
+
+// scanMember reads a member selected with memberColumns.
+func scanMember(row scanner) (*Member, error) {
+	member := Member{}
+	err := row.Scan(&member.GroupID, &member.UserID, &member.Name, &member.Role,
+		&member.Vetoes, &member.VotesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// GetUserByIdentity returns the user linked to the given identity at an OpenID
+// Connect provider. A linked user who is inactive gets a Forbidden error
+// rather than NotFound, so no new user is provisioned for the identity.
+func (s *Store) GetUserByIdentity(issuer, subject string) (*User, error) {
+	s, end := s.trace("GetUserByIdentity")
+	defer end()
+
+	row := s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users
+		JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2`,
+		issuer, subject)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if user.Inactive {
+		return nil, NewServerError(http.StatusForbidden, "user is inactive")
+	}
+
+	return user, nil
+}
+
+// LinkIdentity links an identity at an OpenID Connect provider to a user.
+func (s *Store) LinkIdentity(userID int64, issuer, subject string) error {
+	s, end := s.trace("LinkIdentity")
+	defer end()
+
+	if !s.userIDExists(userID) {
+		return ErrNotFound
+	}
+
+	return s.linkIdentity(s.db, userID, issuer, subject)
+}
+
+// linkIdentity links an identity to a user, on its own or as part of a
+// transaction.
+func (s *Store) linkIdentity(db execer, userID int64, issuer, subject string) error {
+	_, err := db.Exec(
+		"INSERT INTO user_identities(issuer, subject, user_id) VALUES($1, $2, $3)",
+		issuer, subject, userID)
+	if err != nil {
+		s.log.Error("error linking identity", "error", err)
+		return ErrConflict
+	}
+
+	s.log.Info("Identity linked", "user_id", userID, "issuer", issuer, "subject", subject)
+	return nil
+}
+
+// ProvisionUser creates a user for an identity at an OpenID Connect provider,
+// if the signup mode lets users register without an invite. The user gets the
+// given name, numbered if it is taken, and a random password so they can only
+// log in through the provider. The identity is linked and the new user
+// audited in the transaction that creates the user.
+func (s *Store) ProvisionUser(issuer, subject, name string) (*User, error) {
+	s, end := s.trace("ProvisionUser")
+	defer end()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	username := name
+	for i := 2; s.usernameExists(username); i++ {
+		username = fmt.Sprintf("%s %d", name, i)
+	}
+
+	req := NewUserRequest{
+		Name:     username,
+		Password: base64.RawURLEncoding.EncodeToString(b),
+	}
+	id, err := s.registerUser(req, "", func(tx *timedTx, id int64) error {
+		if err := s.linkIdentity(tx, id, issuer, subject); err != nil {
+			return err
+		}
+
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+		if err != nil {
+			return NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		after, err := snapshot(auditUser(user))
+		if err != nil {
+			return NewServerError(http.StatusInternalServerError, err.Error())
+		}
+
+		return s.logAudit(tx, AuditEntry{ActorID: id, Action: AuditUserCreate,
+			TargetType: AuditTargetUser, TargetID: id, After: after,
+			RequestID: requestID(s.db.ctx)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetUserByID(id)
+}
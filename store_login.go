@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Kinds of keys failed logins are counted by. Failures for a user name are
+// counted from any address, and for the user name from each address.
+const (
+	loginKindUser   = "user"
+	loginKindUserIP = "user_ip"
+	loginKindIP     = "ip"
+)
+
+// LoginRetryAfter returns how long logins for the given user name or from the
+// given address must wait before trying again, or zero if they can try now.
+func (s *Store) LoginRetryAfter(username, ip string) (time.Duration, error) {
+	s, end := s.trace("LoginRetryAfter")
+	defer end()
+
+	rows, err := s.db.Query(
+		`SELECT locked_until FROM login_failures
+		WHERE (kind = $1 AND key = $2) OR (kind = $3 AND key = $4) OR (kind = $5 AND key = $6)`,
+		loginKindUser, username, loginKindUserIP, loginUserIPKey(username, ip), loginKindIP, ip)
+	if err != nil {
+		s.log.Error("error getting login failures", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	var wait time.Duration
+	for rows.Next() {
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&lockedUntil); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return 0, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		if lockedUntil.Valid {
+			wait = max(wait, time.Until(lockedUntil.Time))
+		}
+	}
+
+	return wait, nil
+}
+
+// RecordLoginFailure counts a failed login for the given user name and
+// address, making them wait or locking them out once they fail too often.
+func (s *Store) RecordLoginFailure(username, ip string) error {
+	s, end := s.trace("RecordLoginFailure")
+	defer end()
+
+	keys := []struct{ kind, key string }{
+		{loginKindUser, username},
+		{loginKindUserIP, loginUserIPKey(username, ip)},
+		{loginKindIP, ip},
+	}
+	for _, k := range keys {
+		if err := s.recordLoginFailure(k.kind, k.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login for one key. The count is
+// incremented and the lock set in one transaction, so concurrent failures
+// are all counted.
+func (s *Store) recordLoginFailure(kind, key string) error {
+	now := time.Now().UTC()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var failures int
+	row := tx.QueryRow(
+		`INSERT INTO login_failures(kind, key, failures, last_failure)
+		VALUES($1, $2, 1, $3)
+		ON CONFLICT(kind, key) DO UPDATE SET
+			failures = CASE WHEN last_failure < $4 THEN 1 ELSE failures + 1 END,
+			last_failure = excluded.last_failure
+		RETURNING failures`,
+		kind, key, now, now.Add(-loginFailureWindow))
+	if err := row.Scan(&failures); err != nil {
+		s.log.Error("error recording login failure", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	var lockedUntil *time.Time
+	wait := loginWait(failures)
+	if kind == loginKindUser {
+		wait = min(wait, loginUserMaxWait)
+	}
+	if wait > 0 {
+		t := now.Add(wait)
+		lockedUntil = &t
+	}
+
+	_, err = tx.Exec("UPDATE login_failures SET locked_until = $1 WHERE kind = $2 AND key = $3",
+		lockedUntil, kind, key)
+	if err != nil {
+		s.log.Error("error recording login failure", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if failures == loginMaxFailures {
+		s.log.Warn("Login locked out", "kind", kind, "key", key)
+	}
+	return nil
+}
+
+// loginWait returns how long to wait after the given number of consecutive
+// failed logins.
+func loginWait(failures int) time.Duration {
+	if failures >= loginMaxFailures {
+		return loginLockout
+	}
+	if failures <= loginFreeFailures {
+		return 0
+	}
+	return min(loginBaseDelay<<(failures-loginFreeFailures-1), loginLockout)
+}
+
+// loginUserIPKey returns the key failed logins for a user name from an address
+// are counted by. Addresses have no spaces, so the user name is everything
+// after the first one.
+func loginUserIPKey(username, ip string) string {
+	return ip + " " + username
+}
+
+// ResetLoginFailures forgets the failed logins for the given user name, from
+// any address and from the given one, after a successful login.
+func (s *Store) ResetLoginFailures(username, ip string) error {
+	s, end := s.trace("ResetLoginFailures")
+	defer end()
+
+	_, err := s.db.Exec(
+		"DELETE FROM login_failures WHERE (kind = $1 AND key = $2) OR (kind = $3 AND key = $4)",
+		loginKindUser, username, loginKindUserIP, loginUserIPKey(username, ip))
+	if err != nil {
+		s.log.Error("error resetting login failures", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+)
+
+// GetCurrentUser returns the user with the given ID, their role and their
+// group memberships.
+func (s *Store) GetCurrentUser(userID int64) (*CurrentUser, error) {
+	s, end := s.trace("GetCurrentUser")
+	defer end()
+
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	me := CurrentUser{ID: user.ID, Name: user.Name, Role: RoleUser}
+	if user.Admin {
+		me.Role = RoleAdmin
+	}
+
+	me.Groups, err = s.getMemberships(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, membership := range me.Groups {
+		if membership.GroupID == defaultGroupID {
+			me.Vetoes = membership.Vetoes
+			me.VotesRemaining = membership.VotesRemaining
+			me.SongsRemaining = membership.SongsRemaining
+		}
+	}
+
+	return &me, nil
+}
+
+// getMemberships returns the groups of a user with what they have left to
+// spend in each.
+func (s *Store) getMemberships(userID int64) ([]Membership, error) {
+	memberships := []Membership{}
+
+	rows, err := s.db.Query(
+		`SELECT `+memberColumns+`, groups.name, groups.song_quota FROM group_members
+		JOIN users ON users.id = group_members.user_id
+		JOIN groups ON groups.id = group_members.group_id
+		WHERE group_members.user_id = $1
+		ORDER BY group_members.group_id`, userID)
+	if err != nil {
+		s.log.Error("error getting memberships from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	quotas := []int{}
+	for rows.Next() {
+		membership := Membership{}
+		var quota int
+		err := rows.Scan(&membership.GroupID, &membership.UserID, &membership.Name,
+			&membership.Role, &membership.Vetoes, &membership.VotesRemaining,
+			&membership.GroupName, &quota)
+		if err != nil {
+			rows.Close()
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		memberships = append(memberships, membership)
+		quotas = append(quotas, quota)
+	}
+	rows.Close()
+
+	// Songs left are counted once the rows are closed, since getting the
+	// current round can start one.
+	for i := range memberships {
+		membership := &memberships[i]
+
+		round, err := s.GetCurrentRound(membership.GroupID)
+		if err != nil {
+			return nil, err
+		}
+
+		added, err := s.songsAdded(s.db, round.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		membership.SongsRemaining = max(quotas[i]-added, 0)
+	}
+
+	return memberships, nil
+}
+
+// songsAdded returns the number of songs a user added in a round.
+func (s *Store) songsAdded(db execer, roundID, userID int64) (int, error) {
+	var added int
+	row := db.QueryRow("SELECT COUNT(*) FROM songs WHERE round_id = $1 AND added_by = $2",
+		roundID, userID)
+	if err := row.Scan(&added); err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	return added, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// OverrideVeto records a user's vote to lift the veto of a song in the current
+// round. Once the round's veto override fraction of active users has voted,
+// the veto is lifted, the song can be voted for again, and, if the round is
+// configured to refund overridden vetoes, the veto is returned to its user.
+func (s *Store) OverrideVeto(req OverrideRequest) (*OverrideResponse, error) {
+	s, end := s.trace("OverrideVeto")
+	defer end()
+
+	// Validate input.
+	if req.SongID < 1 || req.UserID < 1 {
+		return nil, fmt.Errorf("invalid song/user ID")
+	}
+
+	if !s.userIDExists(req.UserID) {
+		return nil, fmt.Errorf("user %d not found", req.UserID)
+	}
+
+	if !s.songIDExists(req.SongID) {
+		return nil, fmt.Errorf("song %d not found", req.SongID)
+	}
+
+	song, err := s.checkSongInCurrentRound(req.SongID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !song.Vetoed {
+		return nil, fmt.Errorf("song %d is not vetoed", req.SongID)
+	}
+
+	if _, err := s.getSongMember(song, req.UserID); err != nil {
+		return nil, err
+	}
+
+	round, err := s.GetCurrentRound(song.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	activeMembers, err := s.countActiveMembers(song.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &OverrideResponse{SongID: req.SongID}
+	resp.Required = int(math.Ceil(round.VetoOverrideFraction * float64(activeMembers)))
+
+	// Record the vote and lift the veto in one transaction, so concurrent
+	// votes can't lift it twice or count a vote twice.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error recording override vote: %v", err)
+	}
+	defer tx.Rollback()
+
+	var vetoed bool
+	row := tx.QueryRow("SELECT vetoed FROM songs WHERE id = $1", req.SongID)
+	if err := row.Scan(&vetoed); err != nil {
+		return nil, fmt.Errorf("song %d not found", req.SongID)
+	}
+	if !vetoed {
+		return nil, fmt.Errorf("song %d is not vetoed", req.SongID)
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO overrides(song_id, user_id) VALUES($1, $2)
+		ON CONFLICT(song_id, user_id) DO NOTHING`,
+		req.SongID, req.UserID)
+	if err != nil {
+		s.log.Error("error recording override vote", "error", err)
+		return nil, fmt.Errorf("error recording override vote: %v", err)
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("user has already voted to override this veto")
+	}
+
+	// Only votes of active users count, like the members the fraction is of.
+	row = tx.QueryRow(
+		`SELECT COUNT(*) FROM overrides
+		JOIN users ON users.id = overrides.user_id
+		WHERE overrides.song_id = $1 AND users.inactive = FALSE`, req.SongID)
+	if err := row.Scan(&resp.Votes); err != nil {
+		s.log.Error("error counting override votes", "error", err)
+		return nil, fmt.Errorf("error counting override votes: %v", err)
+	}
+
+	if resp.Votes >= resp.Required {
+		if err := s.liftVeto(tx, song, round.VetoOverrideRefund); err != nil {
+			return nil, err
+		}
+		resp.Lifted = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error recording override vote: %v", err)
+	}
+
+	s.log.Info("New override vote created", "song_id", req.SongID, "user_id", req.UserID)
+	if resp.Lifted {
+		s.log.Info("Veto overridden", "song_id", song.ID, "refunded", round.VetoOverrideRefund)
+	}
+	return resp, nil
+}
+
+// liftVeto clears the vetoed flag of a song, marks its veto as overridden
+// and, if refund is true, returns the veto to the user who cast it, as part of
+// transaction tx.
+func (s *Store) liftVeto(tx *timedTx, song *Song, refund bool) error {
+	now := time.Now().UTC()
+	_, err := tx.Exec("UPDATE songs SET vetoed = FALSE, updated_at = $1 WHERE id = $2", now, song.ID)
+	if err != nil {
+		s.log.Error("error updating veto field of song", "error", err)
+		return fmt.Errorf("error updating veto field of song: %v", err)
+	}
+
+	if refund {
+		_, err := tx.Exec(
+			`UPDATE group_members SET vetoes = vetoes + 1
+			WHERE group_id = $1 AND user_id IN
+				(SELECT user_id FROM vetoes WHERE song_id = $2 AND overridden = FALSE)`,
+			song.GroupID, song.ID)
+		if err != nil {
+			s.log.Error("error refunding veto", "error", err)
+			return fmt.Errorf("error refunding veto: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE vetoes SET overridden = TRUE, updated_at = $1 WHERE song_id = $2", now, song.ID)
+	if err != nil {
+		s.log.Error("error marking veto overridden", "error", err)
+		return fmt.Errorf("error marking veto overridden: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// ChangePassword sets a new password for a user who knows their current one,
+// ending the user's sessions. It returns the user's new session version.
+func (s *Store) ChangePassword(userID int64, req ChangePasswordRequest) (int, error) {
+	s, end := s.trace("ChangePassword")
+	defer end()
+
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = comparePassword(s.db.ctx, []byte(user.Password), req.CurrentPassword)
+	if err != nil {
+		return 0, NewServerError(http.StatusUnauthorized, "incorrect password")
+	}
+
+	pwd, err := s.hashNewPassword(req.NewPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.setPassword(s.db, userID, pwd)
+}
+
+// CreatePasswordReset creates a reset token for a user on behalf of an admin.
+func (s *Store) CreatePasswordReset(userID, createdBy int64) (*PasswordReset, error) {
+	s, end := s.trace("CreatePasswordReset")
+	defer end()
+
+	if _, err := s.GetUserByID(userID); err != nil {
+		return nil, err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	reset := &PasswordReset{
+		UserID:    userID,
+		Token:     token,
+		ExpiresAt: time.Now().UTC().Add(passwordResetLifetime),
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO password_resets(user_id, token_hash, created_by, expires_at)
+		VALUES($1, $2, $3, $4)`,
+		userID, hashToken(token), createdBy, reset.ExpiresAt)
+	if err != nil {
+		s.log.Error("error creating password reset", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Password reset created", "user_id", userID, "created_by", createdBy)
+	return reset, nil
+}
+
+// ResetPassword sets a new password for the active user of an unused,
+// unexpired reset token, ending the user's sessions and using up all their
+// reset tokens. The token is claimed before the password is set, in the same
+// transaction that audits the reset, so it can only be used once.
+func (s *Store) ResetPassword(req ResetPasswordRequest) error {
+	s, end := s.trace("ResetPassword")
+	defer end()
+
+	pwd, err := s.hashNewPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	row := tx.QueryRow(
+		`UPDATE password_resets SET used = TRUE
+		WHERE token_hash = $1 AND used = FALSE AND expires_at > $2
+		RETURNING user_id`, hashToken(req.Token), time.Now().UTC())
+	if err := row.Scan(&userID); err != nil {
+		return NewServerError(http.StatusUnauthorized, "invalid or expired reset token")
+	}
+
+	var inactive bool
+	row = tx.QueryRow("SELECT inactive FROM users WHERE id = $1", userID)
+	if err := row.Scan(&inactive); err != nil || inactive {
+		return NewServerError(http.StatusUnauthorized, "invalid or expired reset token")
+	}
+
+	if _, err := s.setPassword(tx, userID, pwd); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE password_resets SET used = TRUE WHERE user_id = $1", userID)
+	if err != nil {
+		s.log.Error("error using up password resets", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := s.revokeSessions(tx, userID, 0); err != nil {
+		return err
+	}
+
+	err = s.logAudit(tx, AuditEntry{ActorID: userID, Action: AuditPasswordReset,
+		TargetType: AuditTargetUser, TargetID: userID, RequestID: requestID(s.db.ctx)})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Password reset", "user_id", userID)
+	return nil
+}
+
+// hashNewPassword checks a new password is given and hashes it.
+func (s *Store) hashNewPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, NewServerError(http.StatusBadRequest, "new password is required")
+	}
+
+	pwd, err := hashPassword(s.db.ctx, password)
+	if err != nil {
+		s.log.Error("error encrypting password", "error", err.Error())
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	return pwd, nil
+}
+
+// setPassword changes a user's password to the given hash and increments their
+// session version to end their sessions, on its own or as part of a
+// transaction. It returns the new session version.
+func (s *Store) setPassword(db execer, userID int64, pwd []byte) (int, error) {
+	var version int
+	row := db.QueryRow(
+		`UPDATE users SET password = $1, session_version = session_version + 1, updated_at = $2
+		WHERE id = $3
+		RETURNING session_version`, pwd, time.Now().UTC(), userID)
+	if err := row.Scan(&version); err != nil {
+		s.log.Error("error updating password", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Password changed", "user_id", userID)
+	return version, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// GetCurrentRound returns the open round of a group. Groups get their first
+// round when they are created.
+func (s *Store) GetCurrentRound(groupID int64) (*Round, error) {
+	s, end := s.trace("GetCurrentRound")
+	defer end()
+
+	row := s.db.QueryRow(
+		`SELECT `+roundColumns+` FROM rounds
+		WHERE group_id = $1 AND closed = FALSE
+		ORDER BY id DESC LIMIT 1`, groupID)
+	round, err := scanRound(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		s.log.Error("error getting current round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	return round, nil
+}
+
+// GetRoundByID returns the round with the given ID.
+func (s *Store) GetRoundByID(id int64) (*Round, error) {
+	s, end := s.trace("GetRoundByID")
+	defer end()
+
+	row := s.db.QueryRow("SELECT "+roundColumns+" FROM rounds WHERE id = $1", id)
+	round, err := scanRound(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return round, nil
+}
+
+// GetRounds returns all rounds of a group, oldest first.
+func (s *Store) GetRounds(groupID int64) ([]Round, error) {
+	s, end := s.trace("GetRounds")
+	defer end()
+
+	rounds := []Round{}
+
+	rows, err := s.db.Query(
+		"SELECT "+roundColumns+" FROM rounds WHERE group_id = $1 ORDER BY id", groupID)
+	if err != nil {
+		s.log.Error("error getting rounds from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		round, err := scanRound(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		rounds = append(rounds, *round)
+	}
+
+	return rounds, nil
+}
+
+// StartNewRound closes the open round of a group, if any, and starts a new one
+// with the same settings and the group's voting method. Vetoes and votes are
+// resupplied to all members.
+func (s *Store) StartNewRound(groupID int64) (*Round, error) {
+	s, end := s.trace("StartNewRound")
+	defer end()
+
+	group, err := s.GetGroupByID(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	round := &Round{
+		VoteBudget:           defaultVoteBudget,
+		VetoOverrideFraction: defaultVetoOverrideFraction,
+	}
+	row := tx.QueryRow(
+		`SELECT `+roundColumns+` FROM rounds
+		WHERE group_id = $1 AND closed = FALSE
+		ORDER BY id DESC LIMIT 1`, groupID)
+	current, err := scanRound(row)
+	if err == nil {
+		round = current
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		s.log.Error("error getting current round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	round.GroupID = groupID
+	round.VotingMethod = group.VotingMethod
+
+	closed, err := tx.Exec(
+		"UPDATE rounds SET closed = TRUE WHERE group_id = $1 AND closed = FALSE", groupID)
+	if err != nil {
+		s.log.Error("error closing round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO rounds(group_id, closed, voting_method, vote_budget,
+			veto_override_fraction, veto_override_refund)
+		VALUES($1, $2, $3, $4, $5, $6)`,
+		groupID, false, round.VotingMethod, round.VoteBudget, round.VetoOverrideFraction,
+		round.VetoOverrideRefund)
+	if err != nil {
+		s.log.Error("error creating round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	round.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	round.Closed = false
+
+	_, err = tx.Exec(
+		"UPDATE group_members SET vetoes = $1, votes_remaining = $2 WHERE group_id = $3",
+		group.VetoAllowance, round.VoteBudget, groupID)
+	if err != nil {
+		s.log.Error("error resupplying vetoes and votes", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if n, _ := closed.RowsAffected(); n > 0 {
+		roundsClosed.inc()
+	}
+	s.log.Info("New round started", "id", round.ID, "group_id", groupID,
+		"voting_method", round.VotingMethod, "vote_budget", round.VoteBudget)
+	return round, nil
+}
+
+// UpdateRound changes the settings of a group's current round. A change to the
+// voting method also becomes the group's voting method, and a change to the
+// vote budget adjusts the votes remaining of every member by the difference,
+// without going below zero.
+func (s *Store) UpdateRound(groupID int64, req RoundRequest) (*Round, error) {
+	s, end := s.trace("UpdateRound")
+	defer end()
+
+	round, err := s.GetCurrentRound(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.VotingMethod != "" {
+		if !validVotingMethod(req.VotingMethod) {
+			return nil, NewServerError(http.StatusBadRequest,
+				fmt.Sprintf("unknown voting method %q", req.VotingMethod))
+		}
+		round.VotingMethod = req.VotingMethod
+	}
+
+	if req.VoteBudget < 0 {
+		return nil, NewServerError(http.StatusBadRequest, "vote budget can't be negative")
+	}
+	budgetChange := 0
+	if req.VoteBudget > 0 {
+		budgetChange = req.VoteBudget - round.VoteBudget
+		round.VoteBudget = req.VoteBudget
+	}
+
+	if req.VetoOverrideFraction < 0 || req.VetoOverrideFraction > 1 {
+		return nil, NewServerError(http.StatusBadRequest,
+			"veto override fraction must be between 0 and 1")
+	}
+	if req.VetoOverrideFraction > 0 {
+		round.VetoOverrideFraction = req.VetoOverrideFraction
+	}
+
+	if req.VetoOverrideRefund != nil {
+		round.VetoOverrideRefund = *req.VetoOverrideRefund
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE rounds
+		SET voting_method = $1, vote_budget = $2, veto_override_fraction = $3,
+			veto_override_refund = $4
+		WHERE id = $5`,
+		round.VotingMethod, round.VoteBudget, round.VetoOverrideFraction,
+		round.VetoOverrideRefund, round.ID)
+	if err != nil {
+		s.log.Error("error updating round", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	_, err = tx.Exec("UPDATE groups SET voting_method = $1 WHERE id = $2",
+		round.VotingMethod, groupID)
+	if err != nil {
+		s.log.Error("error updating group voting method", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	_, err = tx.Exec(
+		`UPDATE group_members SET votes_remaining = MAX(votes_remaining + $1, 0)
+		WHERE group_id = $2`, budgetChange, groupID)
+	if err != nil {
+		s.log.Error("error adjusting votes remaining", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Round updated", "id", round.ID, "voting_method", round.VotingMethod,
+		"vote_budget", round.VoteBudget)
+	return round, nil
+}
+
+// roundColumns lists the rounds table columns in the order scanRound expects.
+const roundColumns = `id, group_id, closed, voting_method, vote_budget,
+	veto_override_fraction, veto_override_refund`
+
+// scanRound reads a round selected with roundColumns.
+func scanRound(row scanner) (*Round, error) {
+	round := Round{}
+	err := row.Scan(&round.ID, &round.GroupID, &round.Closed, &round.VotingMethod,
+		&round.VoteBudget, &round.VetoOverrideFraction, &round.VetoOverrideRefund)
+	if err != nil {
+		return nil, err
+	}
+	return &round, nil
+}
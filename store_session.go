@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// CreateSession records a new logged in session of a user and returns its ID.
+// The sessions of all users that have expired since are pruned first.
+func (s *Store) CreateSession(userID int64, userAgent, ip string) (int64, error) {
+	s, end := s.trace("CreateSession")
+	defer end()
+
+	now := time.Now().UTC()
+	pruned, err := s.db.Exec("DELETE FROM user_sessions WHERE last_seen < $1",
+		now.Add(-sessionLifetime))
+	if err != nil {
+		s.log.Error("error pruning expired sessions", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if n, _ := pruned.RowsAffected(); n > 0 {
+		s.log.Info("Expired sessions pruned", "count", n)
+	}
+
+	result, err := s.db.Exec(
+		`INSERT INTO user_sessions(user_id, created_at, last_seen, user_agent, ip)
+		VALUES($1, $2, $3, $4, $5)`,
+		userID, now, now, userAgent, ip)
+	if err != nil {
+		s.log.Error("error creating session", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	return id, nil
+}
+
+// GetSessions returns the logged in sessions of a user that haven't expired,
+// most recently seen first.
+func (s *Store) GetSessions(userID int64) ([]Session, error) {
+	s, end := s.trace("GetSessions")
+	defer end()
+
+	sessions := []Session{}
+
+	rows, err := s.db.Query(
+		`SELECT id, created_at, last_seen, user_agent, ip FROM user_sessions
+		WHERE user_id = $1 AND last_seen >= $2
+		ORDER BY last_seen DESC, id DESC`, userID, time.Now().UTC().Add(-sessionLifetime))
+	if err != nil {
+		s.log.Error("error getting sessions from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		session := Session{}
+		err := rows.Scan(&session.ID, &session.CreatedAt, &session.LastSeen, &session.UserAgent,
+			&session.IP)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// CountActiveSessions returns the number of logged in sessions seen since the
+// given time.
+func (s *Store) CountActiveSessions(since time.Time) (int, error) {
+	s, end := s.trace("CountActiveSessions")
+	defer end()
+
+	var count int
+	row := s.db.QueryRow("SELECT COUNT(*) FROM user_sessions WHERE last_seen >= $1", since.UTC())
+	if err := row.Scan(&count); err != nil {
+		s.log.Error("error counting sessions", "error", err)
+		return 0, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	return count, nil
+}
+
+// TouchSession reports whether a session of a user is still logged in, and
+// if so updates when it was last seen, at most once per sessionSeenInterval.
+func (s *Store) TouchSession(userID, id int64) (bool, error) {
+	s, end := s.trace("TouchSession")
+	defer end()
+
+	var lastSeen time.Time
+	row := s.db.QueryRow("SELECT last_seen FROM user_sessions WHERE id = $1 AND user_id = $2",
+		id, userID)
+	if err := row.Scan(&lastSeen); err != nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(lastSeen) < sessionSeenInterval {
+		return true, nil
+	}
+
+	_, err := s.db.Exec("UPDATE user_sessions SET last_seen = $1 WHERE id = $2", now, id)
+	if err != nil {
+		s.log.Error("error updating session last seen", "error", err)
+		return false, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	return true, nil
+}
+
+// RevokeSession logs out a session of a user.
+func (s *Store) RevokeSession(userID, id int64) error {
+	s, end := s.trace("RevokeSession")
+	defer end()
+
+	result, err := s.db.Exec("DELETE FROM user_sessions WHERE id = $1 AND user_id = $2",
+		id, userID)
+	if err != nil {
+		s.log.Error("error revoking session", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	s.log.Info("Session revoked", "id", id, "user_id", userID)
+	return nil
+}
+
+// RevokeSessions logs out all sessions of a user except the one with ID
+// except, which can be zero to log out all of them.
+func (s *Store) RevokeSessions(userID, except int64) error {
+	s, end := s.trace("RevokeSessions")
+	defer end()
+
+	return s.revokeSessions(s.db, userID, except)
+}
+
+// revokeSessions logs out sessions like RevokeSessions, on its own or as part
+// of a transaction.
+func (s *Store) revokeSessions(db execer, userID, except int64) error {
+	result, err := db.Exec("DELETE FROM user_sessions WHERE user_id = $1 AND id != $2",
+		userID, except)
+	if err != nil {
+		s.log.Error("error revoking sessions", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	revoked, _ := result.RowsAffected()
+	s.log.Info("Sessions revoked", "user_id", userID, "count", revoked)
+	return nil
+}
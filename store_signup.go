@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RegisterUser creates a new user if the signup mode allows it. While signup
+// is invite-only, inviteToken must be a valid invite, and the redemption is
+// recorded. An invite given while signup is open is recorded too. The invite
+// is redeemed in the transaction that creates the user, so the user is only
+// created if it can be.
+func (s *Store) RegisterUser(req NewUserRequest, inviteToken string) (int64, error) {
+	s, end := s.trace("RegisterUser")
+	defer end()
+
+	return s.registerUser(req, inviteToken, nil)
+}
+
+// registerUser creates a new user like RegisterUser, then calls then with the
+// transaction and the new user's ID if it isn't nil.
+func (s *Store) registerUser(req NewUserRequest, inviteToken string,
+	then func(tx *timedTx, id int64) error) (int64, error) {
+	mode, err := s.GetSignupMode()
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == SignupDisabled {
+		return 0, NewServerError(http.StatusForbidden, "signup is disabled")
+	}
+
+	return s.createUser(req, func(tx *timedTx, id int64) error {
+		if inviteToken != "" || mode == SignupInvite {
+			if err := s.redeemInvite(tx, inviteToken, id); err != nil {
+				return err
+			}
+		}
+
+		if then != nil {
+			return then(tx, id)
+		}
+		return nil
+	})
+}
+
+// GetSignupMode returns who can register. Signup is open unless an admin
+// changed it.
+func (s *Store) GetSignupMode() (SignupMode, error) {
+	s, end := s.trace("GetSignupMode")
+	defer end()
+
+	var mode SignupMode
+	row := s.db.QueryRow("SELECT value FROM settings WHERE name = 'signup_mode'")
+	err := row.Scan(&mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SignupOpen, nil
+	}
+	if err != nil {
+		s.log.Error("error getting signup mode", "error", err)
+		return "", NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	return mode, nil
+}
+
+// SetSignupMode changes who can register.
+func (s *Store) SetSignupMode(mode SignupMode) error {
+	s, end := s.trace("SetSignupMode")
+	defer end()
+
+	switch mode {
+	case SignupOpen, SignupInvite, SignupDisabled:
+	default:
+		return NewServerError(http.StatusBadRequest,
+			fmt.Sprintf("unknown signup mode %q", mode))
+	}
+
+	_, err := s.db.Exec(
+		"INSERT OR REPLACE INTO settings(name, value) VALUES('signup_mode', $1)", mode)
+	if err != nil {
+		s.log.Error("error setting signup mode", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("Signup mode changed", "mode", mode)
+	return nil
+}
+
+// CreateInvite creates an invite on behalf of the given user.
+func (s *Store) CreateInvite(createdBy int64, req InviteRequest) (*Invite, error) {
+	s, end := s.trace("CreateInvite")
+	defer end()
+
+	if req.ExpiresIn < 0 {
+		return nil, NewServerError(http.StatusBadRequest, "expiry can't be negative")
+	}
+
+	if !req.SingleUse && req.ExpiresIn == 0 {
+		return nil, NewServerError(http.StatusBadRequest,
+			"invite must be single-use or expire")
+	}
+
+	if !s.userIDExists(createdBy) {
+		return nil, ErrNotFound
+	}
+
+	token, err := newInviteCode()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	invite := &Invite{
+		Token:       token,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now().UTC(),
+		SingleUse:   req.SingleUse,
+		Redemptions: []InviteRedemption{},
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := invite.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Hour)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	result, err := s.db.Exec(
+		`INSERT INTO invites(token, created_by, created_at, single_use, expires_at)
+		VALUES($1, $2, $3, $4, $5)`,
+		invite.Token, invite.CreatedBy, invite.CreatedAt, invite.SingleUse, invite.ExpiresAt)
+	if err != nil {
+		s.log.Error("error creating invite", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	invite.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("New invite created", "id", invite.ID, "created_by", createdBy,
+		"single_use", invite.SingleUse, "expires_at", invite.ExpiresAt)
+	return invite, nil
+}
+
+// GetInvites returns all invites with the users who registered with them,
+// newest first.
+func (s *Store) GetInvites() ([]Invite, error) {
+	s, end := s.trace("GetInvites")
+	defer end()
+
+	invites := []Invite{}
+
+	rows, err := s.db.Query("SELECT " + inviteColumns + " FROM invites ORDER BY id DESC")
+	if err != nil {
+		s.log.Error("error getting invites from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		invites = append(invites, *invite)
+	}
+	rows.Close()
+
+	for i := range invites {
+		invites[i].Redemptions, err = s.getInviteRedemptions(invites[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return invites, nil
+}
+
+// redeemInvite records that the given user registered with the invite with
+// the given token, as part of the transaction creating the user. A single-use
+// invite is claimed by the same statement that records its redemption, so it
+// can't be redeemed twice.
+func (s *Store) redeemInvite(tx *timedTx, token string, userID int64) error {
+	if token == "" {
+		return NewServerError(http.StatusForbidden, "signup needs an invite")
+	}
+
+	row := tx.QueryRow("SELECT "+inviteColumns+" FROM invites WHERE token = $1", token)
+	invite, err := scanInvite(row)
+	if err != nil {
+		return NewServerError(http.StatusForbidden, "invalid invite")
+	}
+
+	now := time.Now().UTC()
+	if invite.ExpiresAt != nil && now.After(*invite.ExpiresAt) {
+		return NewServerError(http.StatusForbidden, "invite has expired")
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO invite_redemptions(invite_id, user_id, redeemed_at)
+		SELECT $1, $2, $3
+		WHERE NOT $4 OR NOT EXISTS (SELECT 1 FROM invite_redemptions WHERE invite_id = $1)`,
+		invite.ID, userID, now, invite.SingleUse)
+	if err != nil {
+		s.log.Error("error redeeming invite", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return NewServerError(http.StatusForbidden, "invite has been used")
+	}
+
+	s.log.Info("Invite redeemed", "invite_id", invite.ID, "user_id", userID)
+	return nil
+}
+
+// getInviteRedemptions returns the users who registered with an invite,
+// oldest first.
+func (s *Store) getInviteRedemptions(inviteID int64) ([]InviteRedemption, error) {
+	redemptions := []InviteRedemption{}
+
+	rows, err := s.db.Query(
+		`SELECT users.id, users.name, invite_redemptions.redeemed_at
+		FROM invite_redemptions JOIN users ON users.id = invite_redemptions.user_id
+		WHERE invite_redemptions.invite_id = $1
+		ORDER BY invite_redemptions.redeemed_at`, inviteID)
+	if err != nil {
+		s.log.Error("error getting invite redemptions", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := InviteRedemption{}
+		if err := rows.Scan(&r.UserID, &r.Name, &r.RedeemedAt); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		redemptions = append(redemptions, r)
+	}
+
+	return redemptions, nil
+}
+
+// inviteColumns lists the invites table columns in the order scanInvite
+// expects.
+const inviteColumns = "id, token, created_by, created_at, single_use, expires_at"
+
+// scanInvite reads an invite selected with inviteColumns.
+func scanInvite(row scanner) (*Invite, error) {
+	invite := Invite{Redemptions: []InviteRedemption{}}
+	var expiresAt sql.NullTime
+	err := row.Scan(&invite.ID, &invite.Token, &invite.CreatedBy, &invite.CreatedAt,
+		&invite.SingleUse, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.Time
+	}
+	return &invite, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+)
+
+// approvedSong is the SQL condition for a song that made the approved list: it
+// has not been vetoed and at least half of the active members of its group
+// voted for it.
+const approvedSong = `songs.vetoed = FALSE AND
+	songs.votes * 2 >= (SELECT COUNT(*) FROM group_members
+		JOIN users ON users.id = group_members.user_id
+		WHERE group_members.group_id = songs.group_id AND users.inactive = FALSE)`
+
+// GetUserProfile returns the member of a group with the given ID along with
+// statistics about the songs they added and the votes and vetoes they cast in
+// that group.
+func (s *Store) GetUserProfile(groupID, id int64) (*UserProfile, error) {
+	s, end := s.trace("GetUserProfile")
+	defer end()
+
+	if _, err := s.GetMember(groupID, id); err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRow("SELECT "+groupUserColumns(groupID)+" FROM users WHERE id = $1", id)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	user.Password = ""
+
+	profile := &UserProfile{User: *user}
+
+	row = s.db.QueryRow(
+		`SELECT
+			COUNT(*),
+			COALESCE(SUM(CASE WHEN `+approvedSong+` THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN songs.vetoed THEN 1 ELSE 0 END), 0)
+		FROM songs WHERE added_by = $1 AND group_id = $2`, id, groupID)
+	err = row.Scan(&profile.SongsAdded, &profile.SongsApproved, &profile.SongsVetoed)
+	if err != nil {
+		s.log.Error("error getting song stats", "user_id", id, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	// Agreement rate is the share of the user's votes that went to songs the
+	// group approved.
+	var agreed int
+	row = s.db.QueryRow(
+		`SELECT
+			COUNT(*),
+			COALESCE(SUM(CASE WHEN `+approvedSong+` THEN 1 ELSE 0 END), 0)
+		FROM votes JOIN songs ON songs.id = votes.song_id
+		WHERE votes.user_id = $1 AND songs.group_id = $2 AND votes.deleted_at IS NULL`,
+		id, groupID)
+	if err := row.Scan(&profile.VotesCast, &agreed); err != nil {
+		s.log.Error("error getting vote stats", "user_id", id, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	if profile.VotesCast > 0 {
+		profile.AgreementRate = float64(agreed) / float64(profile.VotesCast)
+	}
+
+	row = s.db.QueryRow(
+		`SELECT COUNT(*) FROM vetoes JOIN songs ON songs.id = vetoes.song_id
+		WHERE vetoes.user_id = $1 AND songs.group_id = $2`, id, groupID)
+	if err := row.Scan(&profile.VetoesUsed); err != nil {
+		s.log.Error("error getting veto stats", "user_id", id, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	profile.FavoriteArtists, err = s.getFavoriteArtists(groupID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// getFavoriteArtists returns the artists the user voted for most often in a
+// group.
+func (s *Store) getFavoriteArtists(groupID, userID int64) ([]ArtistCount, error) {
+	artists := []ArtistCount{}
+
+	rows, err := s.db.Query(
+		`SELECT songs.artist, COUNT(*) AS n
+		FROM votes JOIN songs ON songs.id = votes.song_id
+		WHERE votes.user_id = $1 AND songs.group_id = $2 AND votes.deleted_at IS NULL
+		GROUP BY songs.artist
+		ORDER BY n DESC, songs.artist
+		LIMIT $3`, userID, groupID, favoriteArtists)
+	if err != nil {
+		s.log.Error("error getting favorite artists", "user_id", userID, "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		artist := ArtistCount{}
+		if err := rows.Scan(&artist.Artist, &artist.Count); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		artists = append(artists, artist)
+	}
+
+	return artists, nil
+}
+
+// GetAnalytics returns the leaderboards and voting trends of a group.
+func (s *Store) GetAnalytics(groupID int64) (*Analytics, error) {
+	s, end := s.trace("GetAnalytics")
+	defer end()
+
+	analytics := &Analytics{}
+	var err error
+
+	analytics.TopContributors, err = s.getUserCounts(groupID,
+		`SELECT users.id, users.name, COUNT(*) AS n
+		FROM songs JOIN users ON users.id = songs.added_by
+		WHERE songs.group_id = $1 AND users.inactive = FALSE AND `+approvedSong+`
+		GROUP BY users.id
+		ORDER BY n DESC, users.name
+		LIMIT $2`)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics.MostVetoed, err = s.getUserCounts(groupID,
+		`SELECT users.id, users.name, COUNT(*) AS n
+		FROM songs JOIN users ON users.id = songs.added_by
+		WHERE songs.group_id = $1 AND users.inactive = FALSE AND songs.vetoed = TRUE
+		GROUP BY users.id
+		ORDER BY n DESC, users.name
+		LIMIT $2`)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics.PopularArtists, err = s.getPopularArtists(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics.Participation, err = s.getParticipation(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics.Controversial, err = s.getControversialSongs(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	return analytics, nil
+}
+
+// getUserCounts runs a leaderboard query for a group returning user ID, name
+// and count rows, limited to leaderboardSize entries.
+func (s *Store) getUserCounts(groupID int64, query string) ([]UserCount, error) {
+	counts := []UserCount{}
+
+	rows, err := s.db.Query(query, groupID, leaderboardSize)
+	if err != nil {
+		s.log.Error("error getting leaderboard", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		count := UserCount{}
+		if err := rows.Scan(&count.UserID, &count.Name, &count.Count); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		counts = append(counts, count)
+	}
+
+	return counts, nil
+}
+
+// getPopularArtists returns the artists with the most votes across all rounds
+// of a group.
+func (s *Store) getPopularArtists(groupID int64) ([]ArtistCount, error) {
+	artists := []ArtistCount{}
+
+	rows, err := s.db.Query(
+		`SELECT artist, SUM(votes) AS n
+		FROM songs
+		WHERE group_id = $1
+		GROUP BY artist
+		ORDER BY n DESC, artist
+		LIMIT $2`, groupID, leaderboardSize)
+	if err != nil {
+		s.log.Error("error getting popular artists", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		artist := ArtistCount{}
+		if err := rows.Scan(&artist.Artist, &artist.Count); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		artists = append(artists, artist)
+	}
+
+	return artists, nil
+}
+
+// getParticipation returns song, vote and voter counts for each round of a
+// group, oldest first. The participation rate is the share of the group's
+// active members who voted in the round.
+func (s *Store) getParticipation(groupID int64) ([]RoundParticipation, error) {
+	participation := []RoundParticipation{}
+
+	activeMembers, err := s.countActiveMembers(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT
+			rounds.id,
+			COUNT(DISTINCT songs.id),
+			COUNT(votes.id),
+			COUNT(DISTINCT votes.user_id)
+		FROM rounds
+		LEFT JOIN songs ON songs.round_id = rounds.id
+		LEFT JOIN votes ON votes.song_id = songs.id AND votes.deleted_at IS NULL
+		WHERE rounds.group_id = $1
+		GROUP BY rounds.id
+		ORDER BY rounds.id`, groupID)
+	if err != nil {
+		s.log.Error("error getting participation", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := RoundParticipation{}
+		if err := rows.Scan(&p.RoundID, &p.Songs, &p.Votes, &p.Voters); err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		if activeMembers > 0 {
+			p.Rate = float64(p.Voters) / float64(activeMembers)
+		}
+		participation = append(participation, p)
+	}
+
+	return participation, nil
+}
+
+// getControversialSongs returns vetoed songs of a group that more than one
+// user voted for, most votes first.
+func (s *Store) getControversialSongs(groupID int64) ([]*Song, error) {
+	songs := []*Song{}
+
+	rows, err := s.db.Query(
+		`SELECT `+songColumns+` FROM songs
+		WHERE group_id = $1 AND vetoed = TRUE AND votes > 1
+		ORDER BY votes DESC, id
+		LIMIT $2`, groupID, leaderboardSize)
+	if err != nil {
+		s.log.Error("error getting controversial songs", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		songs = append(songs, song)
+	}
+
+	return songs, nil
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestUserStore(t *testing.T) {
@@ -52,7 +60,7 @@ func TestUserStore(t *testing.T) {
 	})
 
 	t.Run("can get all users", func(t *testing.T) {
-		users, err := s.GetUsers()
+		users, err := s.GetUsers(defaultGroupID, TimeRange{})
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(users))
 	})
@@ -78,6 +86,11 @@ func TestUserStore(t *testing.T) {
 			Vetoes:   2,
 		}
 
+		// Passwords have their own endpoint.
+		err = s.UpdateUser(&updatedUser)
+		assert.Error(t, err)
+
+		updatedUser.Password = ""
 		err = s.UpdateUser(&updatedUser)
 		assert.NoError(t, err)
 
@@ -168,10 +181,15 @@ func TestSongStore(t *testing.T) {
 		req := VoteRequest{1, 1}
 		_, err := s.VoteForSong(req)
 		assert.Error(t, err)
+		assert.Equal(t, http.StatusConflict, err.(ServerError).Code)
+
+		song, err := s.GetSongByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, song.Votes)
 	})
 
 	t.Run("can get all songs", func(t *testing.T) {
-		songs, err := s.GetSongs()
+		songs, err := s.GetSongs(defaultGroupID, TimeRange{})
 		assert.NoError(t, err)
 		assert.Equal(t, 1, len(songs))
 
@@ -200,6 +218,11 @@ func TestSongStore(t *testing.T) {
 		req := VetoRequest{1, 2}
 		_, err := s.VetoSong(req)
 		assert.Error(t, err)
+		assert.Equal(t, http.StatusConflict, err.(ServerError).Code)
+
+		member, err := s.GetMember(defaultGroupID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, initialVetoes, member.Vetoes)
 	})
 
 	t.Run("user can't veto without vetoes", func(t *testing.T) {
@@ -216,5 +239,1591 @@ func TestSongStore(t *testing.T) {
 		vetoReq := VetoRequest{2, 1}
 		_, err = s.VetoSong(vetoReq)
 		assert.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.(ServerError).Code)
+
+		song, err := s.GetSongByID(2)
+		assert.NoError(t, err)
+		assert.False(t, song.Vetoed)
+	})
+
+	t.Run("songs from closed rounds can't be vetoed", func(t *testing.T) {
+		_, err := s.StartNewRound(defaultGroupID)
+		assert.NoError(t, err)
+
+		_, err = s.VetoSong(VetoRequest{2, 2})
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.(ServerError).Code)
+	})
+}
+
+func TestUserProfile(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	songs := []NewSongRequest{
+		{AddedBy: 1, Title: "Mirror In The Bathroom", Artist: "The Beat"},
+		{AddedBy: 1, Title: "Dead Man's Party", Artist: "Oingo Boingo"},
+		{AddedBy: 2, Title: "Weird Science", Artist: "Oingo Boingo"},
+	}
+	for _, req := range songs {
+		_, err := s.CreateSong(req)
+		assert.NoError(t, err)
+	}
+
+	// Song 1 gets two of three votes and is approved, song 2 is vetoed.
+	_, err = s.VoteForSong(VoteRequest{SongID: 1, UserID: 2})
+	assert.NoError(t, err)
+	_, err = s.VoteForSong(VoteRequest{SongID: 3, UserID: 1})
+	assert.NoError(t, err)
+	_, err = s.VetoSong(VetoRequest{SongID: 2, UserID: 3})
+	assert.NoError(t, err)
+
+	t.Run("counts songs, votes and vetoes", func(t *testing.T) {
+		profile, err := s.GetUserProfile(defaultGroupID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "John Doe", profile.Name)
+		assert.Empty(t, profile.Password)
+		assert.Equal(t, 2, profile.SongsAdded)
+		assert.Equal(t, 1, profile.SongsApproved)
+		assert.Equal(t, 1, profile.SongsVetoed)
+		assert.Equal(t, 3, profile.VotesCast)
+		assert.Equal(t, 0, profile.VetoesUsed)
+
+		profile, err = s.GetUserProfile(defaultGroupID, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, profile.VotesCast)
+		assert.Equal(t, 1, profile.VetoesUsed)
+		assert.Equal(t, 0.0, profile.AgreementRate)
+	})
+
+	t.Run("computes agreement rate", func(t *testing.T) {
+		// John voted for songs 1, 2 and 3; songs 1 and 3 were approved.
+		profile, err := s.GetUserProfile(defaultGroupID, 1)
+		assert.NoError(t, err)
+		assert.InDelta(t, 2.0/3.0, profile.AgreementRate, 0.001)
+	})
+
+	t.Run("lists favorite artists", func(t *testing.T) {
+		profile, err := s.GetUserProfile(defaultGroupID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []ArtistCount{{"Oingo Boingo", 2}, {"The Beat", 1}},
+			profile.FavoriteArtists)
+	})
+
+	t.Run("fails on non-existent user", func(t *testing.T) {
+		_, err := s.GetUserProfile(defaultGroupID, 999)
+		assert.Error(t, err)
+	})
+
+	t.Run("only counts activity in the group", func(t *testing.T) {
+		band, err := s.CreateGroup(1, GroupRequest{Name: "Band"})
+		assert.NoError(t, err)
+		song, err := s.CreateSong(NewSongRequest{band.ID, 1, "Lost In Space", "Oingo Boingo", ""})
+		assert.NoError(t, err)
+		assert.NotZero(t, song)
+
+		profile, err := s.GetUserProfile(band.ID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, profile.SongsAdded)
+		assert.Equal(t, 1, profile.VotesCast)
+		assert.Equal(t, []ArtistCount{{"Oingo Boingo", 1}}, profile.FavoriteArtists)
+
+		profile, err = s.GetUserProfile(defaultGroupID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, profile.SongsAdded)
+		assert.Equal(t, 3, profile.VotesCast)
+
+		_, err = s.GetUserProfile(band.ID, 2)
+		assert.Error(t, err)
+
+		users, err := s.GetUsers(band.ID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, users, 1)
+		assert.Equal(t, "John Doe", users[0].Name)
+	})
+}
+
+func TestMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "songvote.db")
+
+	// Create a db with the tables of the first release.
+	old, err := sql.Open("sqlite", path)
+	assert.NoError(t, err)
+	_, err = old.Exec(
+		`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL,
+			password TEXT NOT NULL, inactive BOOLEAN, vetoes INTEGER);
+		CREATE TABLE songs (id INTEGER PRIMARY KEY, title TEXT NOT NULL,
+			artist TEXT NOT NULL, link_url TEXT, votes INTEGER, vetoed BOOLEAN,
+			added_by INTEGER NOT NULL);
+		CREATE TABLE votes (id INTEGER PRIMARY KEY, song_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL);
+		CREATE TABLE vetoes (id INTEGER PRIMARY KEY, song_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL);
+		INSERT INTO users(name, password, inactive, vetoes)
+			VALUES('John Doe', 'x', FALSE, 0), ('Jane Doe', 'x', FALSE, 1);
+		INSERT INTO songs(title, artist, link_url, votes, vetoed, added_by)
+			VALUES('Song', 'Artist', '', 1, TRUE, 1), ('Other', 'Artist', '', 1, FALSE, 2);
+		INSERT INTO votes(song_id, user_id) VALUES(1, 1), (2, 2);
+		INSERT INTO vetoes(song_id, user_id) VALUES(1, 1);`)
+	assert.NoError(t, err)
+	assert.NoError(t, old.Close())
+
+	s, err := NewStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.CheckMigrations())
+
+	t.Run("keeps the vetoes users had left", func(t *testing.T) {
+		member, err := s.GetMember(defaultGroupID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, member.Vetoes)
+
+		member, err = s.GetMember(defaultGroupID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, member.Vetoes)
+
+		_, err = s.VetoSong(VetoRequest{SongID: 2, UserID: 1})
+		assert.Error(t, err)
+	})
+
+	t.Run("puts existing songs in the first round", func(t *testing.T) {
+		round, err := s.GetCurrentRound(defaultGroupID)
+		assert.NoError(t, err)
+
+		song, err := s.GetSongByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, round.ID, song.RoundID)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: 2, UserID: 1})
+		assert.NoError(t, err)
+	})
+}
+
+func TestRoundStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	_, err = s.CreateUser(NewUserRequest{"John Doe", "password"})
+	assert.NoError(t, err)
+
+	t.Run("first round is started with the group", func(t *testing.T) {
+		round, err := s.GetCurrentRound(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), round.ID)
+		assert.False(t, round.Closed)
+	})
+
+	t.Run("songs are added to the current round", func(t *testing.T) {
+		id, err := s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Just Another Day", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+
+		song, err := s.GetSongByID(id)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), song.RoundID)
+	})
+
+	t.Run("new round closes the old one and resupplies vetoes", func(t *testing.T) {
+		_, err := s.VetoSong(VetoRequest{SongID: 1, UserID: 1})
+		assert.NoError(t, err)
+
+		round, err := s.StartNewRound(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), round.ID)
+
+		rounds, err := s.GetRounds(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(rounds))
+		assert.True(t, rounds[0].Closed)
+		assert.False(t, rounds[1].Closed)
+		assert.Equal(t, MethodApproval, rounds[1].VotingMethod)
+		assert.Equal(t, defaultVoteBudget, rounds[1].VoteBudget)
+		assert.Equal(t, defaultVetoOverrideFraction, rounds[1].VetoOverrideFraction)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, initialVetoes, user.Vetoes)
+	})
+}
+
+func TestAnalytics(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	// Round 1: John's song is approved, Jane's song is vetoed after two votes.
+	_, err = s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Only A Lad", Artist: "Oingo Boingo"})
+	assert.NoError(t, err)
+	_, err = s.CreateSong(NewSongRequest{AddedBy: 2, Title: "Tainted Love", Artist: "Soft Cell"})
+	assert.NoError(t, err)
+	_, err = s.VoteForSong(VoteRequest{SongID: 1, UserID: 3})
+	assert.NoError(t, err)
+	_, err = s.VoteForSong(VoteRequest{SongID: 2, UserID: 1})
+	assert.NoError(t, err)
+	_, err = s.VetoSong(VetoRequest{SongID: 2, UserID: 3})
+	assert.NoError(t, err)
+
+	// Round 2: only John takes part.
+	_, err = s.StartNewRound(defaultGroupID)
+	assert.NoError(t, err)
+	_, err = s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Little Girls", Artist: "Oingo Boingo"})
+	assert.NoError(t, err)
+
+	a, err := s.GetAnalytics(defaultGroupID)
+	assert.NoError(t, err)
+
+	t.Run("ranks top contributors", func(t *testing.T) {
+		assert.Equal(t, []UserCount{{1, "John Doe", 1}}, a.TopContributors)
+	})
+
+	t.Run("ranks most vetoed users", func(t *testing.T) {
+		assert.Equal(t, []UserCount{{2, "Jane Doe", 1}}, a.MostVetoed)
+	})
+
+	t.Run("ranks popular artists", func(t *testing.T) {
+		assert.Equal(t, []ArtistCount{{"Oingo Boingo", 3}, {"Soft Cell", 2}}, a.PopularArtists)
+	})
+
+	t.Run("reports participation per round", func(t *testing.T) {
+		assert.Equal(t, 2, len(a.Participation))
+		assert.Equal(t, RoundParticipation{1, 2, 4, 3, 1}, a.Participation[0])
+		assert.Equal(t, int64(2), a.Participation[1].RoundID)
+		assert.Equal(t, 1, a.Participation[1].Voters)
+		assert.InDelta(t, 1.0/3.0, a.Participation[1].Rate, 0.001)
+	})
+
+	t.Run("lists controversial songs", func(t *testing.T) {
+		assert.Equal(t, 1, len(a.Controversial))
+		assert.Equal(t, "Tainted Love", a.Controversial[0].Title)
+	})
+}
+
+func TestBallotStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	titles := []string{"Stay", "Insanity", "Nothing To Fear", "Grey Matter"}
+	for i, title := range titles {
+		_, err := s.CreateSong(NewSongRequest{AddedBy: int64(i%3 + 1), Title: title, Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+	}
+	_, err = s.VetoSong(VetoRequest{SongID: 4, UserID: 1})
+	assert.NoError(t, err)
+
+	t.Run("approval rounds don't take ballots", func(t *testing.T) {
+		_, err := s.SubmitBallot(BallotRequest{UserID: 1, Choices: []int64{1}})
+		assert.Error(t, err)
+	})
+
+	t.Run("approval rounds are tallied from votes", func(t *testing.T) {
+		result, err := s.TallyRound(1)
+		assert.NoError(t, err)
+		assert.Equal(t, MethodApproval, result.Method)
+		assert.Equal(t, 3, result.Ballots)
+		assert.Equal(t, []SongScore{{1, 1}, {2, 1}, {3, 1}}, result.Ranking)
+	})
+
+	t.Run("rejects unknown voting method", func(t *testing.T) {
+		_, err := s.UpdateRound(defaultGroupID, RoundRequest{VotingMethod: "plurality"})
+		assert.Error(t, err)
+	})
+
+	t.Run("can change voting method", func(t *testing.T) {
+		round, err := s.UpdateRound(defaultGroupID, RoundRequest{VotingMethod: MethodBorda})
+		assert.NoError(t, err)
+		assert.Equal(t, MethodBorda, round.VotingMethod)
+	})
+
+	t.Run("rejects invalid ballots", func(t *testing.T) {
+		invalid := [][]int64{
+			{1, 1},   // repeated song
+			{1, 4},   // vetoed song
+			{1, 999}, // unknown song
+		}
+		for _, choices := range invalid {
+			_, err := s.SubmitBallot(BallotRequest{UserID: 1, Choices: choices})
+			assert.Error(t, err, choices)
+		}
+
+		_, err := s.SubmitBallot(BallotRequest{UserID: 999, Choices: []int64{1}})
+		assert.Error(t, err)
+	})
+
+	t.Run("resubmitting replaces the ballot", func(t *testing.T) {
+		_, err := s.SubmitBallot(BallotRequest{UserID: 1, Choices: []int64{1, 2}})
+		assert.NoError(t, err)
+		_, err = s.SubmitBallot(BallotRequest{UserID: 1, Choices: []int64{3, 2, 1}})
+		assert.NoError(t, err)
+		_, err = s.SubmitBallot(BallotRequest{UserID: 2, Choices: []int64{2, 3}})
+		assert.NoError(t, err)
+
+		ballots, err := s.GetBallots(1)
+		assert.NoError(t, err)
+		assert.Equal(t, []Ballot{{1, []int64{3, 2, 1}}, {2, []int64{2, 3}}}, ballots)
+	})
+
+	t.Run("tallies with the round's method", func(t *testing.T) {
+		result, err := s.TallyRound(1)
+		assert.NoError(t, err)
+		assert.Equal(t, MethodBorda, result.Method)
+		// 1: 0, 2: 1+2, 3: 2+1
+		assert.Equal(t, []SongScore{{2, 3}, {3, 3}, {1, 0}}, result.Ranking)
+	})
+
+	t.Run("limited ballots can't exceed the vote budget", func(t *testing.T) {
+		_, err := s.UpdateRound(defaultGroupID, RoundRequest{VotingMethod: MethodLimited, VoteBudget: 2})
+		assert.NoError(t, err)
+
+		_, err = s.SubmitBallot(BallotRequest{UserID: 3, Choices: []int64{1, 2, 3}})
+		assert.Error(t, err)
+
+		_, err = s.SubmitBallot(BallotRequest{UserID: 3, Choices: []int64{1, 2}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("new rounds keep the round settings", func(t *testing.T) {
+		round, err := s.StartNewRound(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Equal(t, MethodLimited, round.VotingMethod)
+		assert.Equal(t, 2, round.VoteBudget)
+	})
+
+	t.Run("tally fails on non-existent round", func(t *testing.T) {
+		_, err := s.TallyRound(999)
+		assert.Error(t, err)
+	})
+}
+
+func TestVoteBudget(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	t.Run("new users get the round's vote budget", func(t *testing.T) {
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, defaultVoteBudget, user.VotesRemaining)
+	})
+
+	t.Run("changing the budget adjusts votes remaining", func(t *testing.T) {
+		_, err := s.UpdateRound(defaultGroupID, RoundRequest{VoteBudget: 2})
+		assert.NoError(t, err)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.VotesRemaining)
+
+		_, err = s.UpdateRound(defaultGroupID, RoundRequest{VoteBudget: -1})
+		assert.Error(t, err)
+	})
+
+	t.Run("adding a song uses a vote", func(t *testing.T) {
+		_, err := s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Goodbye-Goodbye", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.VotesRemaining)
+	})
+
+	t.Run("voting is limited by the budget", func(t *testing.T) {
+		_, err := s.CreateSong(NewSongRequest{AddedBy: 2, Title: "Private Life", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: 2, UserID: 1})
+		assert.NoError(t, err)
+
+		_, err = s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Nasty Habits", Artist: "Oingo Boingo"})
+		assert.Error(t, err)
+		songs, err := s.GetSongs(defaultGroupID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, songs, 2)
+
+		_, err = s.CreateSong(NewSongRequest{AddedBy: 2, Title: "Nasty Habits", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: 3, UserID: 1})
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, err.(ServerError).Code)
+
+		song, err := s.GetSongByID(3)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, song.Votes)
+	})
+
+	t.Run("retracting a vote refunds it", func(t *testing.T) {
+		err := s.RetractVote(VoteRequest{SongID: 2, UserID: 1})
+		assert.NoError(t, err)
+
+		song, err := s.GetSongByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, song.Votes)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.VotesRemaining)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: 3, UserID: 1})
+		assert.NoError(t, err)
+	})
+
+	t.Run("can't retract a vote that wasn't cast", func(t *testing.T) {
+		err := s.RetractVote(VoteRequest{SongID: 2, UserID: 1})
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusNotFound, err.(ServerError).Code)
+	})
+
+	t.Run("new round resupplies votes", func(t *testing.T) {
+		_, err := s.StartNewRound(defaultGroupID)
+		assert.NoError(t, err)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.VotesRemaining)
+	})
+
+	t.Run("songs from closed rounds are closed for voting", func(t *testing.T) {
+		_, err := s.VoteForSong(VoteRequest{SongID: 2, UserID: 1})
+		assert.Error(t, err)
+
+		err = s.RetractVote(VoteRequest{SongID: 3, UserID: 1})
+		assert.Error(t, err)
+	})
+}
+
+func TestVetoOverride(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe", "Joan Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	for _, title := range []string{"Forbidden Zone", "Ain't This The Life"} {
+		_, err := s.CreateSong(NewSongRequest{AddedBy: 1, Title: title, Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+	}
+
+	t.Run("can't override a song that isn't vetoed", func(t *testing.T) {
+		_, err := s.OverrideVeto(OverrideRequest{SongID: 1, UserID: 1})
+		assert.Error(t, err)
+	})
+
+	t.Run("veto stays until enough users vote to lift it", func(t *testing.T) {
+		_, err := s.VetoSong(VetoRequest{SongID: 1, UserID: 4})
+		assert.NoError(t, err)
+
+		// Two thirds of four users rounds up to three votes.
+		for _, userID := range []int64{1, 2} {
+			resp, err := s.OverrideVeto(OverrideRequest{SongID: 1, UserID: userID})
+			assert.NoError(t, err)
+			assert.Equal(t, 3, resp.Required)
+			assert.False(t, resp.Lifted)
+		}
+
+		song, err := s.GetSongByID(1)
+		assert.NoError(t, err)
+		assert.True(t, song.Vetoed)
+	})
+
+	t.Run("user can't vote to override twice", func(t *testing.T) {
+		_, err := s.OverrideVeto(OverrideRequest{SongID: 1, UserID: 1})
+		assert.Error(t, err)
+	})
+
+	t.Run("reaching the threshold lifts the veto", func(t *testing.T) {
+		resp, err := s.OverrideVeto(OverrideRequest{SongID: 1, UserID: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, OverrideResponse{SongID: 1, Votes: 3, Required: 3, Lifted: true}, *resp)
+
+		song, err := s.GetSongByID(1)
+		assert.NoError(t, err)
+		assert.False(t, song.Vetoed)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: 1, UserID: 2})
+		assert.NoError(t, err)
+	})
+
+	t.Run("veto is not refunded by default", func(t *testing.T) {
+		user, err := s.GetUserByID(4)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, user.Vetoes)
+	})
+
+	t.Run("overridden song can't be vetoed again", func(t *testing.T) {
+		_, err := s.VetoSong(VetoRequest{SongID: 1, UserID: 3})
+		assert.Error(t, err)
+	})
+
+	t.Run("veto can be refunded", func(t *testing.T) {
+		refund := true
+		_, err := s.UpdateRound(defaultGroupID, RoundRequest{VetoOverrideFraction: 0.5, VetoOverrideRefund: &refund})
+		assert.NoError(t, err)
+
+		_, err = s.VetoSong(VetoRequest{SongID: 2, UserID: 3})
+		assert.NoError(t, err)
+
+		for _, userID := range []int64{1, 2} {
+			_, err := s.OverrideVeto(OverrideRequest{SongID: 2, UserID: userID})
+			assert.NoError(t, err)
+		}
+
+		user, err := s.GetUserByID(3)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.Vetoes)
+	})
+
+	t.Run("rejects invalid fractions", func(t *testing.T) {
+		_, err := s.UpdateRound(defaultGroupID, RoundRequest{VetoOverrideFraction: 1.5})
+		assert.Error(t, err)
+	})
+
+	t.Run("only votes of active users count", func(t *testing.T) {
+		songID, err := s.CreateSong(NewSongRequest{AddedBy: 2, Title: "Stay", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+		_, err = s.VetoSong(VetoRequest{SongID: songID, UserID: 3})
+		assert.NoError(t, err)
+
+		_, err = s.OverrideVeto(OverrideRequest{SongID: songID, UserID: 1})
+		assert.NoError(t, err)
+		assert.NoError(t, s.DeleteUser(1))
+
+		// Half of the three active users rounds up to two votes.
+		resp, err := s.OverrideVeto(OverrideRequest{SongID: songID, UserID: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, OverrideResponse{SongID: songID, Votes: 1, Required: 2}, *resp)
+	})
+}
+
+func TestConcurrentOverrides(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "songvote.db"))
+	assert.NoError(t, err)
+
+	const users = 6
+	for i := 1; i <= users; i++ {
+		_, err := s.CreateUser(NewUserRequest{fmt.Sprint("User ", i), "password"})
+		assert.NoError(t, err)
+	}
+
+	refund := true
+	_, err = s.UpdateRound(defaultGroupID, RoundRequest{VetoOverrideRefund: &refund})
+	assert.NoError(t, err)
+	songID, err := s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Song", Artist: "Artist"})
+	assert.NoError(t, err)
+	_, err = s.VetoSong(VetoRequest{SongID: songID, UserID: 1})
+	assert.NoError(t, err)
+
+	// Every user votes twice at once to lift the veto.
+	responses := make(chan *OverrideResponse, 2*users)
+	var wg sync.WaitGroup
+	for i := 0; i < 2*users; i++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			resp, err := s.OverrideVeto(OverrideRequest{SongID: songID, UserID: userID})
+			if err == nil {
+				responses <- resp
+			}
+		}(int64(i%users + 1))
+	}
+	wg.Wait()
+	close(responses)
+
+	// Two thirds of six users is four votes, after which the song isn't
+	// vetoed any more.
+	votes, lifted := 0, 0
+	for resp := range responses {
+		votes++
+		if resp.Lifted {
+			lifted++
+		}
+	}
+	assert.Equal(t, 4, votes)
+	assert.Equal(t, 1, lifted)
+
+	var count int
+	assert.NoError(t, s.db.QueryRow("SELECT COUNT(*) FROM overrides").Scan(&count))
+	assert.Equal(t, 4, count)
+
+	member, err := s.GetMember(defaultGroupID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, initialVetoes, member.Vetoes)
+}
+
+func TestGroupStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	var band *Group
+
+	t.Run("creates group with its owner as member", func(t *testing.T) {
+		band, err = s.CreateGroup(2, GroupRequest{Name: "Band", VetoAllowance: 2, SongQuota: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, band.VetoAllowance)
+		assert.Equal(t, 1, band.SongQuota)
+		assert.Equal(t, MethodApproval, band.VotingMethod)
+		assert.NotEmpty(t, band.InviteCode)
+
+		member, err := s.GetMember(band.ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleOwner, member.Role)
+		assert.Equal(t, 2, member.Vetoes)
+
+		rounds, err := s.GetRounds(band.ID)
+		assert.NoError(t, err)
+		assert.Len(t, rounds, 1)
+		assert.False(t, rounds[0].Closed)
+	})
+
+	t.Run("rejects invalid group settings", func(t *testing.T) {
+		_, err := s.CreateGroup(2, GroupRequest{})
+		assert.Error(t, err)
+
+		_, err = s.CreateGroup(2, GroupRequest{Name: "Choir", VotingMethod: "plurality"})
+		assert.Error(t, err)
+	})
+
+	t.Run("joins group with invite code", func(t *testing.T) {
+		_, err := s.JoinGroup(3, "not a code")
+		assert.Error(t, err)
+
+		member, err := s.JoinGroup(3, band.InviteCode)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleMember, member.Role)
+
+		_, err = s.JoinGroup(3, band.InviteCode)
+		assert.ErrorIs(t, err, ErrConflict)
+
+		members, err := s.GetMembers(band.ID)
+		assert.NoError(t, err)
+		assert.Len(t, members, 2)
+
+		groups, err := s.GetGroupsByUserID(3)
+		assert.NoError(t, err)
+		assert.Len(t, groups, 2)
+	})
+
+	var bandSongID, defaultSongID int64
+
+	t.Run("non-members can't add songs to a group", func(t *testing.T) {
+		_, err := s.CreateSong(NewSongRequest{GroupID: band.ID, AddedBy: 1, Title: "Weird Science", Artist: "Oingo Boingo"})
+		assert.Error(t, err)
+
+		bandSongID, err = s.CreateSong(NewSongRequest{GroupID: band.ID, AddedBy: 2, Title: "Weird Science", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+
+		defaultSongID, err = s.CreateSong(NewSongRequest{AddedBy: 1, Title: "Weird Science", Artist: "Oingo Boingo"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("song quota is per group", func(t *testing.T) {
+		_, err := s.CreateSong(NewSongRequest{GroupID: band.ID, AddedBy: 2, Title: "Dead Man's Party", Artist: "Oingo Boingo"})
+		assert.Error(t, err)
+	})
+
+	t.Run("groups only see their own songs", func(t *testing.T) {
+		songs, err := s.GetSongs(band.ID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, songs, 1)
+		assert.Equal(t, bandSongID, songs[0].ID)
+
+		songs, err = s.GetSongs(defaultGroupID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, songs, 1)
+		assert.Equal(t, defaultSongID, songs[0].ID)
+	})
+
+	t.Run("non-members can't vote on or veto a group's songs", func(t *testing.T) {
+		_, err := s.VoteForSong(VoteRequest{SongID: bandSongID, UserID: 1})
+		assert.Error(t, err)
+
+		_, err = s.VetoSong(VetoRequest{SongID: bandSongID, UserID: 1})
+		assert.Error(t, err)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: bandSongID, UserID: 3})
+		assert.NoError(t, err)
+	})
+
+	t.Run("non-members can't submit ballots", func(t *testing.T) {
+		_, err := s.SubmitBallot(BallotRequest{GroupID: band.ID, UserID: 1})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("rounds are separate per group", func(t *testing.T) {
+		_, err := s.StartNewRound(band.ID)
+		assert.NoError(t, err)
+
+		rounds, err := s.GetRounds(band.ID)
+		assert.NoError(t, err)
+		assert.Len(t, rounds, 2)
+
+		rounds, err = s.GetRounds(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Len(t, rounds, 1)
+
+		// Votes in the default group's round are unaffected.
+		_, err = s.VoteForSong(VoteRequest{SongID: defaultSongID, UserID: 3})
+		assert.NoError(t, err)
+	})
+
+	t.Run("updates group settings", func(t *testing.T) {
+		group, err := s.UpdateGroup(band.ID, GroupRequest{VotingMethod: MethodBorda})
+		assert.NoError(t, err)
+		assert.Equal(t, "Band", group.Name)
+		assert.Equal(t, MethodBorda, group.VotingMethod)
+
+		round, err := s.GetCurrentRound(band.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, MethodBorda, round.VotingMethod)
+
+		round, err = s.GetCurrentRound(defaultGroupID)
+		assert.NoError(t, err)
+		assert.Equal(t, MethodApproval, round.VotingMethod)
+	})
+}
+
+func TestSignupStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	t.Run("first user is an admin", func(t *testing.T) {
+		_, err := s.RegisterUser(NewUserRequest{"John Doe", "password"}, "")
+		assert.NoError(t, err)
+
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.True(t, user.Admin)
+
+		_, err = s.RegisterUser(NewUserRequest{"Jane Doe", "password"}, "")
+		assert.NoError(t, err)
+
+		user, err = s.GetUserByID(2)
+		assert.NoError(t, err)
+		assert.False(t, user.Admin)
+	})
+
+	t.Run("rejects unknown signup modes", func(t *testing.T) {
+		err := s.SetSignupMode("closed")
+		assert.Error(t, err)
+	})
+
+	t.Run("nobody can register while signup is disabled", func(t *testing.T) {
+		assert.NoError(t, s.SetSignupMode(SignupDisabled))
+
+		_, err := s.RegisterUser(NewUserRequest{"Jim Doe", "password"}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("invites must be single-use or expire", func(t *testing.T) {
+		_, err := s.CreateInvite(1, InviteRequest{})
+		assert.Error(t, err)
+
+		_, err = s.CreateInvite(1, InviteRequest{ExpiresIn: -1})
+		assert.Error(t, err)
+	})
+
+	t.Run("single-use invite can only be redeemed once", func(t *testing.T) {
+		assert.NoError(t, s.SetSignupMode(SignupInvite))
+
+		_, err := s.RegisterUser(NewUserRequest{"Jim Doe", "password"}, "")
+		assert.Error(t, err)
+
+		invite, err := s.CreateInvite(1, InviteRequest{SingleUse: true})
+		assert.NoError(t, err)
+		assert.Nil(t, invite.ExpiresAt)
+
+		_, err = s.RegisterUser(NewUserRequest{"Jim Doe", "password"}, invite.Token)
+		assert.NoError(t, err)
+
+		_, err = s.RegisterUser(NewUserRequest{"Joan Doe", "password"}, invite.Token)
+		assert.Error(t, err)
+		assert.False(t, s.usernameExists("Joan Doe"))
+	})
+
+	t.Run("expiring invite can be redeemed until it expires", func(t *testing.T) {
+		invite, err := s.CreateInvite(1, InviteRequest{ExpiresIn: 24})
+		assert.NoError(t, err)
+		assert.NotNil(t, invite.ExpiresAt)
+
+		for _, name := range []string{"Joan Doe", "Jack Doe"} {
+			_, err := s.RegisterUser(NewUserRequest{name, "password"}, invite.Token)
+			assert.NoError(t, err)
+		}
+
+		_, err = s.db.Exec("UPDATE invites SET expires_at = $1 WHERE id = $2",
+			time.Now().Add(-time.Hour), invite.ID)
+		assert.NoError(t, err)
+
+		_, err = s.RegisterUser(NewUserRequest{"Jill Doe", "password"}, invite.Token)
+		assert.Error(t, err)
+	})
+
+	t.Run("records who invited whom", func(t *testing.T) {
+		invites, err := s.GetInvites()
+		assert.NoError(t, err)
+		assert.Len(t, invites, 2)
+
+		// Newest first.
+		assert.Equal(t, int64(1), invites[0].CreatedBy)
+		assert.Len(t, invites[0].Redemptions, 2)
+		assert.Equal(t, "Joan Doe", invites[0].Redemptions[0].Name)
+		assert.Len(t, invites[1].Redemptions, 1)
+		assert.Equal(t, "Jim Doe", invites[1].Redemptions[0].Name)
+	})
+}
+
+func TestLoginThrottle(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	t.Run("wait doubles with each failure until lockout", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), loginWait(loginFreeFailures))
+		assert.Equal(t, loginBaseDelay, loginWait(loginFreeFailures+1))
+		assert.Equal(t, 2*loginBaseDelay, loginWait(loginFreeFailures+2))
+		assert.Equal(t, loginLockout, loginWait(loginMaxFailures))
+	})
+
+	t.Run("free failures don't make the user wait", func(t *testing.T) {
+		for i := 0; i < loginFreeFailures; i++ {
+			assert.NoError(t, s.RecordLoginFailure("John Doe", "10.0.0.1"))
+		}
+
+		wait, err := s.LoginRetryAfter("John Doe", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	})
+
+	t.Run("further failures make user name and address wait", func(t *testing.T) {
+		assert.NoError(t, s.RecordLoginFailure("John Doe", "10.0.0.1"))
+
+		wait, err := s.LoginRetryAfter("John Doe", "10.0.0.2")
+		assert.NoError(t, err)
+		assert.Greater(t, wait, time.Duration(0))
+
+		wait, err = s.LoginRetryAfter("Jane Doe", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Greater(t, wait, time.Duration(0))
+
+		wait, err = s.LoginRetryAfter("Jane Doe", "10.0.0.2")
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	})
+
+	t.Run("too many failures lock the user out from that address only", func(t *testing.T) {
+		for i := loginFreeFailures + 1; i < loginMaxFailures; i++ {
+			assert.NoError(t, s.RecordLoginFailure("John Doe", "10.0.0.1"))
+		}
+
+		wait, err := s.LoginRetryAfter("John Doe", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Greater(t, wait, loginLockout-time.Minute)
+
+		wait, err = s.LoginRetryAfter("John Doe", "10.0.0.2")
+		assert.NoError(t, err)
+		assert.Greater(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, loginUserMaxWait)
+	})
+
+	t.Run("old failures are forgotten", func(t *testing.T) {
+		_, err := s.db.Exec("UPDATE login_failures SET last_failure = $1",
+			time.Now().UTC().Add(-2*loginFailureWindow))
+		assert.NoError(t, err)
+
+		assert.NoError(t, s.RecordLoginFailure("John Doe", "10.0.0.1"))
+
+		var failures int
+		row := s.db.QueryRow("SELECT failures FROM login_failures WHERE kind = 'user'")
+		assert.NoError(t, row.Scan(&failures))
+		assert.Equal(t, 1, failures)
+	})
+
+	t.Run("successful login resets the user name only", func(t *testing.T) {
+		assert.NoError(t, s.ResetLoginFailures("John Doe", "10.0.0.1"))
+
+		var count int
+		row := s.db.QueryRow("SELECT COUNT(*) FROM login_failures")
+		assert.NoError(t, row.Scan(&count))
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestConcurrentLoginFailures(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "songvote.db"))
+	assert.NoError(t, err)
+
+	const attempts = 20
+	errs := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.RecordLoginFailure("John Doe", "10.0.0.1")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var failures int
+	row := s.db.QueryRow("SELECT failures FROM login_failures WHERE kind = $1 AND key = $2",
+		loginKindUser, "John Doe")
+	assert.NoError(t, row.Scan(&failures))
+	assert.Equal(t, attempts, failures)
+
+	wait, err := s.LoginRetryAfter("John Doe", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Greater(t, wait, loginLockout-time.Minute)
+}
+
+func TestConcurrentVetoesAndSongs(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "songvote.db"))
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	// run calls f concurrently for each of n values and returns how many
+	// calls succeeded.
+	run := func(n int, f func(i int) error) int {
+		errs := make(chan error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- f(i)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		succeeded := 0
+		for err := range errs {
+			if err == nil {
+				succeeded++
+			}
+		}
+		return succeeded
+	}
+
+	t.Run("song quota holds", func(t *testing.T) {
+		added := run(2*defaultSongQuota, func(i int) error {
+			_, err := s.CreateSong(NewSongRequest{AddedBy: 1, Title: fmt.Sprint("Song ", i),
+				Artist: "Artist"})
+			return err
+		})
+		assert.Equal(t, defaultSongQuota, added)
+
+		songs, err := s.GetSongs(defaultGroupID, TimeRange{})
+		assert.NoError(t, err)
+		assert.Len(t, songs, defaultSongQuota)
+		for _, song := range songs {
+			assert.Equal(t, 1, song.Votes)
+		}
+	})
+
+	t.Run("vetoes can't be overspent", func(t *testing.T) {
+		vetoed := run(defaultSongQuota, func(i int) error {
+			_, err := s.VetoSong(VetoRequest{SongID: int64(i + 1), UserID: 2})
+			return err
+		})
+		assert.Equal(t, initialVetoes, vetoed)
+
+		member, err := s.GetMember(defaultGroupID, 2)
+		assert.NoError(t, err)
+		assert.Zero(t, member.Vetoes)
+	})
+}
+
+func TestAPITokenStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	var token *APIToken
+
+	t.Run("creates token", func(t *testing.T) {
+		token, err = s.CreateAPIToken(2, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeVote}})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(token.Token, apiTokenPrefix))
+		assert.Nil(t, token.LastUsed)
+	})
+
+	t.Run("rejects invalid tokens", func(t *testing.T) {
+		_, err := s.CreateAPIToken(2, APITokenRequest{Scopes: []TokenScope{ScopeRead}})
+		assert.Error(t, err)
+
+		_, err = s.CreateAPIToken(2, APITokenRequest{Name: "bot"})
+		assert.Error(t, err)
+
+		_, err = s.CreateAPIToken(2, APITokenRequest{Name: "bot", Scopes: []TokenScope{"write"}})
+		assert.Error(t, err)
+	})
+
+	t.Run("only admins get the admin scope", func(t *testing.T) {
+		_, err := s.CreateAPIToken(2, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeAdmin}})
+		assert.Error(t, err)
+
+		_, err = s.CreateAPIToken(1, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeAdmin}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("scopes include the ones before them", func(t *testing.T) {
+		assert.True(t, token.HasScope(ScopeRead))
+		assert.True(t, token.HasScope(ScopeVote))
+		assert.False(t, token.HasScope(ScopeAdmin))
+	})
+
+	t.Run("account scope is only given explicitly", func(t *testing.T) {
+		admin := APIToken{Scopes: []TokenScope{ScopeAdmin}}
+		assert.False(t, admin.HasScope(ScopeAccount))
+
+		account, err := s.CreateAPIToken(1, APITokenRequest{Name: "account",
+			Scopes: []TokenScope{ScopeAccount}})
+		assert.NoError(t, err)
+		assert.True(t, account.HasScope(ScopeAccount))
+		assert.False(t, account.HasScope(ScopeRead))
+	})
+
+	t.Run("authenticates token and records its use", func(t *testing.T) {
+		_, err := s.AuthenticateAPIToken("sv_nope")
+		assert.Error(t, err)
+
+		authed, err := s.AuthenticateAPIToken(token.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), authed.UserID)
+
+		tokens, err := s.GetAPITokens(2)
+		assert.NoError(t, err)
+		assert.Len(t, tokens, 1)
+		assert.Empty(t, tokens[0].Token)
+		assert.NotNil(t, tokens[0].LastUsed)
+		assert.Equal(t, []TokenScope{ScopeVote}, tokens[0].Scopes)
+	})
+
+	t.Run("inactive users' tokens don't work", func(t *testing.T) {
+		assert.NoError(t, s.DeleteUser(2))
+		_, err := s.AuthenticateAPIToken(token.Token)
+		assert.Error(t, err)
+	})
+
+	t.Run("revokes only own tokens", func(t *testing.T) {
+		assert.ErrorIs(t, s.RevokeAPIToken(1, token.ID), ErrNotFound)
+		assert.NoError(t, s.RevokeAPIToken(2, token.ID))
+
+		tokens, err := s.GetAPITokens(2)
+		assert.NoError(t, err)
+		assert.Empty(t, tokens)
+	})
+}
+
+func TestPasswordStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	checkPassword := func(t *testing.T, userID int64, password string) {
+		user, err := s.GetUserByID(userID)
+		assert.NoError(t, err)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)))
+	}
+
+	t.Run("change needs the current password", func(t *testing.T) {
+		_, err := s.ChangePassword(2, ChangePasswordRequest{"wrong", "new_password"})
+		assert.Error(t, err)
+
+		_, err = s.ChangePassword(2, ChangePasswordRequest{"password", ""})
+		assert.Error(t, err)
+
+		version, err := s.ChangePassword(2, ChangePasswordRequest{"password", "new_password"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, version)
+		checkPassword(t, 2, "new_password")
+	})
+
+	t.Run("reset token sets a new password once", func(t *testing.T) {
+		reset, err := s.CreatePasswordReset(2, 1)
+		assert.NoError(t, err)
+
+		assert.Error(t, s.ResetPassword(ResetPasswordRequest{"wrong", "reset_password"}))
+
+		assert.NoError(t, s.ResetPassword(ResetPasswordRequest{reset.Token, "reset_password"}))
+		checkPassword(t, 2, "reset_password")
+
+		user, err := s.GetUserByID(2)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.SessionVersion)
+
+		assert.Error(t, s.ResetPassword(ResetPasswordRequest{reset.Token, "again"}))
+	})
+
+	t.Run("reset uses up the user's other tokens", func(t *testing.T) {
+		first, err := s.CreatePasswordReset(2, 1)
+		assert.NoError(t, err)
+		second, err := s.CreatePasswordReset(2, 1)
+		assert.NoError(t, err)
+
+		assert.NoError(t, s.ResetPassword(ResetPasswordRequest{second.Token, "password"}))
+		assert.Error(t, s.ResetPassword(ResetPasswordRequest{first.Token, "password"}))
+	})
+
+	t.Run("reset token expires", func(t *testing.T) {
+		reset, err := s.CreatePasswordReset(2, 1)
+		assert.NoError(t, err)
+
+		_, err = s.db.Exec("UPDATE password_resets SET expires_at = $1",
+			time.Now().UTC().Add(-time.Minute))
+		assert.NoError(t, err)
+
+		assert.Error(t, s.ResetPassword(ResetPasswordRequest{reset.Token, "expired"}))
+	})
+
+	t.Run("reset is audited", func(t *testing.T) {
+		log, err := s.GetAuditLog(AuditFilter{Action: AuditPasswordReset})
+		assert.NoError(t, err)
+		assert.Len(t, log, 2)
+		assert.Equal(t, int64(2), log[0].ActorID)
+		assert.Equal(t, int64(2), log[0].TargetID)
+	})
+
+	t.Run("deleted users can't reset their password", func(t *testing.T) {
+		reset, err := s.CreatePasswordReset(2, 1)
+		assert.NoError(t, err)
+		assert.NoError(t, s.DeleteUser(2))
+
+		assert.Error(t, s.ResetPassword(ResetPasswordRequest{reset.Token, "deleted"}))
+		var password string
+		assert.NoError(t, s.db.QueryRow("SELECT password FROM users WHERE id = 2").Scan(&password))
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(password), []byte("password")))
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	ids := []int64{}
+	for _, agent := range []string{"phone", "laptop", "tablet"} {
+		id, err := s.CreateSession(1, agent, "10.0.0.1")
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	janeID, err := s.CreateSession(2, "phone", "10.0.0.2")
+	assert.NoError(t, err)
+
+	t.Run("lists only the user's sessions", func(t *testing.T) {
+		sessions, err := s.GetSessions(1)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 3)
+		for _, session := range sessions {
+			assert.Equal(t, "10.0.0.1", session.IP)
+			assert.False(t, session.CreatedAt.IsZero())
+		}
+	})
+
+	t.Run("touch reports whether the session is active", func(t *testing.T) {
+		active, err := s.TouchSession(1, ids[0])
+		assert.NoError(t, err)
+		assert.True(t, active)
+
+		active, err = s.TouchSession(1, janeID)
+		assert.NoError(t, err)
+		assert.False(t, active)
+	})
+
+	t.Run("revokes one session of the user", func(t *testing.T) {
+		assert.ErrorIs(t, s.RevokeSession(1, janeID), ErrNotFound)
+		assert.NoError(t, s.RevokeSession(1, ids[0]))
+
+		active, err := s.TouchSession(1, ids[0])
+		assert.NoError(t, err)
+		assert.False(t, active)
+	})
+
+	t.Run("revokes all but one session", func(t *testing.T) {
+		assert.NoError(t, s.RevokeSessions(1, ids[2]))
+
+		sessions, err := s.GetSessions(1)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+		assert.Equal(t, ids[2], sessions[0].ID)
+	})
+
+	t.Run("deleting a user revokes all sessions", func(t *testing.T) {
+		assert.NoError(t, s.DeleteUser(1))
+
+		sessions, err := s.GetSessions(1)
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		sessions, err = s.GetSessions(2)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+	})
+
+	t.Run("expired sessions are hidden and then pruned", func(t *testing.T) {
+		_, err := s.db.Exec("UPDATE user_sessions SET last_seen = $1 WHERE id = $2",
+			time.Now().UTC().Add(-sessionLifetime-time.Minute), janeID)
+		assert.NoError(t, err)
+
+		sessions, err := s.GetSessions(2)
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		_, err = s.CreateSession(2, "laptop", "10.0.0.2")
+		assert.NoError(t, err)
+
+		var count int
+		row := s.db.QueryRow("SELECT COUNT(*) FROM user_sessions WHERE id = $1", janeID)
+		assert.NoError(t, row.Scan(&count))
+		assert.Zero(t, count)
+	})
+}
+
+func TestCurrentUserStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	band, err := s.CreateGroup(2, GroupRequest{Name: "Band", VetoAllowance: 2, SongQuota: 1})
+	assert.NoError(t, err)
+
+	_, err = s.CreateSong(NewSongRequest{defaultGroupID, 2, "Song", "Artist", ""})
+	assert.NoError(t, err)
+
+	t.Run("first user is an admin", func(t *testing.T) {
+		me, err := s.GetCurrentUser(1)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleAdmin, me.Role)
+		assert.Len(t, me.Groups, 1)
+	})
+
+	t.Run("lists memberships with what is left to spend", func(t *testing.T) {
+		me, err := s.GetCurrentUser(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Doe", me.Name)
+		assert.Equal(t, RoleUser, me.Role)
+		assert.Equal(t, initialVetoes, me.Vetoes)
+		assert.Equal(t, defaultVoteBudget-1, me.VotesRemaining)
+		assert.Equal(t, defaultSongQuota-1, me.SongsRemaining)
+
+		assert.Len(t, me.Groups, 2)
+		assert.Equal(t, defaultGroupName, me.Groups[0].GroupName)
+		assert.Equal(t, band.ID, me.Groups[1].GroupID)
+		assert.Equal(t, "Band", me.Groups[1].GroupName)
+		assert.Equal(t, RoleOwner, me.Groups[1].Role)
+		assert.Equal(t, 2, me.Groups[1].Vetoes)
+		assert.Equal(t, 1, me.Groups[1].SongsRemaining)
+	})
+
+	t.Run("deleted users are not found", func(t *testing.T) {
+		assert.NoError(t, s.DeleteUser(2))
+		_, err := s.GetCurrentUser(2)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestAuditStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	entries := []AuditEntry{
+		{ActorID: 1, Action: AuditUserCreate, TargetType: AuditTargetUser, TargetID: 1,
+			After: []byte(`{"name":"John Doe"}`), RequestID: "a"},
+		{ActorID: 1, Action: AuditSongCreate, TargetType: AuditTargetSong, TargetID: 1,
+			RequestID: "b"},
+		{ActorID: 2, Action: AuditVoteCreate, TargetType: AuditTargetSong, TargetID: 1,
+			RequestID: "c"},
+	}
+	for _, entry := range entries {
+		assert.NoError(t, s.LogAudit(entry))
+	}
+
+	t.Run("returns entries newest first", func(t *testing.T) {
+		log, err := s.GetAuditLog(AuditFilter{})
+		assert.NoError(t, err)
+		assert.Len(t, log, 3)
+		assert.Equal(t, "c", log[0].RequestID)
+		assert.JSONEq(t, `{"name":"John Doe"}`, string(log[2].After))
+		assert.Nil(t, log[2].Before)
+	})
+
+	t.Run("filters entries", func(t *testing.T) {
+		log, err := s.GetAuditLog(AuditFilter{ActorID: 1})
+		assert.NoError(t, err)
+		assert.Len(t, log, 2)
+
+		log, err = s.GetAuditLog(AuditFilter{TargetType: AuditTargetSong, TargetID: 1, Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, log, 1)
+		assert.Equal(t, AuditVoteCreate, log[0].Action)
+
+		log, err = s.GetAuditLog(AuditFilter{TimeRange: TimeRange{Since: time.Now().Add(time.Hour)}})
+		assert.NoError(t, err)
+		assert.Empty(t, log)
+
+		_, err = s.GetAuditLog(AuditFilter{Limit: -1})
+		assert.Error(t, err)
+	})
+
+	t.Run("is append-only", func(t *testing.T) {
+		_, err := s.db.Exec("UPDATE audit_log SET actor_id = 3")
+		assert.Error(t, err)
+
+		_, err = s.db.Exec("DELETE FROM audit_log")
+		assert.Error(t, err)
+	})
+}
+
+func TestTimestamps(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	songID, err := s.CreateSong(NewSongRequest{defaultGroupID, 1, "Song", "Artist", ""})
+	assert.NoError(t, err)
+
+	t.Run("records creation times", func(t *testing.T) {
+		user, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		assert.NotNil(t, user.CreatedAt)
+		assert.Equal(t, user.CreatedAt, user.UpdatedAt)
+		assert.Nil(t, user.DeletedAt)
+
+		song, err := s.GetSongByID(songID)
+		assert.NoError(t, err)
+		assert.False(t, song.CreatedAt.Before(start.Truncate(time.Second)))
+	})
+
+	t.Run("records update times", func(t *testing.T) {
+		song, err := s.GetSongByID(songID)
+		assert.NoError(t, err)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: songID, UserID: 2})
+		assert.NoError(t, err)
+
+		voted, err := s.GetSongByID(songID)
+		assert.NoError(t, err)
+		assert.False(t, voted.UpdatedAt.Before(*song.UpdatedAt))
+	})
+
+	t.Run("retracted votes are soft deleted", func(t *testing.T) {
+		assert.NoError(t, s.RetractVote(VoteRequest{SongID: songID, UserID: 2}))
+
+		votes, err := s.GetVotesBySongID(songID)
+		assert.NoError(t, err)
+		assert.Len(t, votes, 1)
+
+		var deleted int
+		row := s.db.QueryRow("SELECT COUNT(*) FROM votes WHERE deleted_at IS NOT NULL")
+		assert.NoError(t, row.Scan(&deleted))
+		assert.Equal(t, 1, deleted)
+
+		_, err = s.VoteForSong(VoteRequest{SongID: songID, UserID: 2})
+		assert.NoError(t, err)
+	})
+
+	t.Run("deleted users keep their deletion time", func(t *testing.T) {
+		assert.NoError(t, s.DeleteUser(2))
+		assert.ErrorIs(t, s.DeleteUser(2), ErrNotFound)
+
+		var deletedAt time.Time
+		row := s.db.QueryRow("SELECT deleted_at FROM users WHERE id = 2")
+		assert.NoError(t, row.Scan(&deletedAt))
+		assert.False(t, deletedAt.IsZero())
+	})
+
+	t.Run("filters lists by creation time", func(t *testing.T) {
+		users, err := s.GetUsers(defaultGroupID, TimeRange{Since: start.Add(-time.Minute)})
+		assert.NoError(t, err)
+		assert.Len(t, users, 1)
+
+		users, err = s.GetUsers(defaultGroupID, TimeRange{Until: start.Add(-time.Minute)})
+		assert.NoError(t, err)
+		assert.Empty(t, users)
+
+		songs, err := s.GetSongs(defaultGroupID, TimeRange{Since: time.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+		assert.Empty(t, songs)
+
+		songs, err = s.GetSongs(defaultGroupID, TimeRange{Since: start.Add(-time.Minute)})
+		assert.NoError(t, err)
+		assert.Len(t, songs, 1)
+	})
+}
+
+func TestUserDataStore(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Doe", "Jane Doe"} {
+		_, err := s.CreateUser(NewUserRequest{name, "password"})
+		assert.NoError(t, err)
+	}
+
+	johnsSong, err := s.CreateSong(NewSongRequest{defaultGroupID, 1, "Song", "Artist", ""})
+	assert.NoError(t, err)
+	janesSong, err := s.CreateSong(NewSongRequest{defaultGroupID, 2, "Other", "Artist", ""})
+	assert.NoError(t, err)
+	_, err = s.VoteForSong(VoteRequest{SongID: johnsSong, UserID: 2})
+	assert.NoError(t, err)
+	_, err = s.VetoSong(VetoRequest{SongID: johnsSong, UserID: 2})
+	assert.NoError(t, err)
+	_, err = s.OverrideVeto(OverrideRequest{SongID: johnsSong, UserID: 2})
+	assert.NoError(t, err)
+	_, err = s.UpdateRound(defaultGroupID, RoundRequest{VotingMethod: MethodRanked})
+	assert.NoError(t, err)
+	_, err = s.SubmitBallot(BallotRequest{UserID: 2, Choices: []int64{janesSong}})
+	assert.NoError(t, err)
+	_, err = s.CreateSession(2, "phone", "10.0.0.2")
+	assert.NoError(t, err)
+	_, err = s.CreateAPIToken(2, APITokenRequest{Name: "bot", Scopes: []TokenScope{ScopeRead}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.LinkIdentity(2, "https://id.example.com", "jane"))
+	assert.NoError(t, s.RecordLoginFailure("Jane Doe", "10.0.0.2"))
+	assert.NoError(t, s.LogAudit(AuditEntry{ActorID: 2, Action: AuditUserCreate,
+		TargetType: AuditTargetUser, TargetID: 2, After: []byte(`{"name":"Jane Doe"}`)}))
+
+	t.Run("exports all of the user's data", func(t *testing.T) {
+		export, err := s.ExportUser(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Doe", export.User.Name)
+		assert.Empty(t, export.User.Password)
+		assert.Len(t, export.Groups, 1)
+		assert.Len(t, export.Songs, 1)
+		assert.Equal(t, janesSong, export.Songs[0].ID)
+		assert.Len(t, export.Votes, 2)
+		assert.Len(t, export.Vetoes, 1)
+		assert.Len(t, export.Ballots, 1)
+		assert.Equal(t, []int64{janesSong}, export.Ballots[0].Choices)
+		assert.Equal(t, []Override{{1, johnsSong, 2}}, export.Overrides)
+		assert.Len(t, export.Sessions, 1)
+		assert.Len(t, export.APITokens, 1)
+	})
+
+	t.Run("exports deleted users", func(t *testing.T) {
+		assert.NoError(t, s.DeleteUser(2))
+
+		export, err := s.ExportUser(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Doe", export.User.Name)
+		assert.True(t, export.User.Inactive)
+		assert.Len(t, export.Groups, 1)
+		assert.Len(t, export.Votes, 2)
+	})
+
+	t.Run("erases the user's personal data", func(t *testing.T) {
+		assert.NoError(t, s.EraseUser(2))
+		assert.ErrorIs(t, s.EraseUser(3), ErrNotFound)
+
+		_, err := s.ExportUser(2)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		_, err = s.GetUserByName("Jane Doe")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = s.GetUserByIdentity("https://id.example.com", "jane")
+		assert.Error(t, err)
+
+		var name string
+		assert.NoError(t, s.db.QueryRow("SELECT name FROM users WHERE id = 2").Scan(&name))
+		assert.Equal(t, "Deleted user 2", name)
+
+		_, err = s.CreateUser(NewUserRequest{"Deleted user 2", "password"})
+		assert.Equal(t, http.StatusBadRequest, err.(ServerError).Code)
+		john, err := s.GetUserByID(1)
+		assert.NoError(t, err)
+		john.Name = "Deleted user 3"
+		assert.Equal(t, http.StatusBadRequest, s.UpdateUser(john).(ServerError).Code)
+
+		for _, table := range []string{"user_sessions", "api_tokens", "user_identities"} {
+			var count int
+			row := s.db.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE user_id = 2")
+			assert.NoError(t, row.Scan(&count))
+			assert.Zero(t, count, table)
+		}
+
+		var failures int
+		row := s.db.QueryRow("SELECT COUNT(*) FROM login_failures WHERE kind != $1", loginKindIP)
+		assert.NoError(t, row.Scan(&failures))
+		assert.Zero(t, failures)
+
+		log, err := s.GetAuditLog(AuditFilter{TargetType: AuditTargetUser, TargetID: 2})
+		assert.NoError(t, err)
+		assert.Len(t, log, 1)
+		assert.Nil(t, log[0].After)
+	})
+
+	t.Run("keeps references and counts intact", func(t *testing.T) {
+		rows, err := s.db.Query("PRAGMA foreign_key_check")
+		assert.NoError(t, err)
+		assert.False(t, rows.Next())
+		rows.Close()
+
+		for _, id := range []int64{johnsSong, janesSong} {
+			song, err := s.GetSongByID(id)
+			assert.NoError(t, err)
+
+			votes, err := s.GetVotesBySongID(id)
+			assert.NoError(t, err)
+			assert.Equal(t, len(votes), song.Votes)
+		}
+
+		song, err := s.GetSongByID(janesSong)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), song.AddedBy)
+
+		vetoed, err := s.GetSongByID(johnsSong)
+		assert.NoError(t, err)
+		assert.True(t, vetoed.Vetoed)
 	})
 }
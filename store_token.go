@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix starts every API token, to make leaked tokens easy to spot.
+const apiTokenPrefix = "sv_"
+
+// CreateAPIToken creates an API token for the given user. Only admins can
+// create tokens with the admin scope.
+func (s *Store) CreateAPIToken(userID int64, req APITokenRequest) (*APIToken, error) {
+	s, end := s.trace("CreateAPIToken")
+	defer end()
+
+	if req.Name == "" {
+		return nil, NewServerError(http.StatusBadRequest, "token name is required")
+	}
+
+	if len(req.Scopes) == 0 {
+		return nil, NewServerError(http.StatusBadRequest, "token needs at least one scope")
+	}
+
+	for _, scope := range req.Scopes {
+		if scopeLevel(scope) < 0 && scope != ScopeAccount {
+			return nil, NewServerError(http.StatusBadRequest,
+				fmt.Sprintf("unknown scope %q", scope))
+		}
+	}
+
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if slices.Contains(req.Scopes, ScopeAdmin) && !user.Admin {
+		return nil, NewServerError(http.StatusForbidden, "only admins can use the admin scope")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	token := &APIToken{
+		UserID:    userID,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Token:     apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	result, err := s.db.Exec(
+		`INSERT INTO api_tokens(user_id, name, token_hash, scopes, created_at)
+		VALUES($1, $2, $3, $4, $5)`,
+		token.UserID, token.Name, hashToken(token.Token), joinScopes(token.Scopes),
+		token.CreatedAt)
+	if err != nil {
+		s.log.Error("error creating API token", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	token.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	s.log.Info("New API token created", "id", token.ID, "user_id", userID, "scopes", req.Scopes)
+	return token, nil
+}
+
+// GetAPITokens returns the API tokens of the given user, without the tokens
+// themselves.
+func (s *Store) GetAPITokens(userID int64) ([]APIToken, error) {
+	s, end := s.trace("GetAPITokens")
+	defer end()
+
+	tokens := []APIToken{}
+
+	rows, err := s.db.Query(
+		"SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		s.log.Error("error getting API tokens from db", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			s.log.Error("error scanning rows", "error", err)
+			return nil, NewServerError(http.StatusInternalServerError, err.Error())
+		}
+		tokens = append(tokens, *token)
+	}
+
+	return tokens, nil
+}
+
+// RevokeAPIToken deletes an API token of the given user.
+func (s *Store) RevokeAPIToken(userID, id int64) error {
+	s, end := s.trace("RevokeAPIToken")
+	defer end()
+
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		s.log.Error("error revoking API token", "error", err)
+		return NewServerError(http.StatusInternalServerError, err.Error())
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	s.log.Info("API token revoked", "id", id, "user_id", userID)
+	return nil
+}
+
+// AuthenticateAPIToken returns the API token matching the given token if its
+// user is active, and records that it was used.
+func (s *Store) AuthenticateAPIToken(token string) (*APIToken, error) {
+	s, end := s.trace("AuthenticateAPIToken")
+	defer end()
+
+	row := s.db.QueryRow(
+		`SELECT `+apiTokenColumns+` FROM api_tokens
+		JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = $1 AND users.inactive = FALSE`, hashToken(token))
+	apiToken, err := scanAPIToken(row)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	now := time.Now().UTC()
+	_, err = s.db.Exec("UPDATE api_tokens SET last_used = $1 WHERE id = $2", now, apiToken.ID)
+	if err != nil {
+		s.log.Error("error updating API token last used", "error", err)
+		return nil, NewServerError(http.StatusInternalServerError, err.Error())
+	}
+	apiToken.LastUsed = &now
+
+	return apiToken, nil
+}
+
+// HasScope reports whether the token can be used for requests needing scope.
+func (t *APIToken) HasScope(scope TokenScope) bool {
+	if scope == ScopeAccount {
+		return slices.Contains(t.Scopes, ScopeAccount)
+	}
+	for _, s := range t.Scopes {
+		if scopeLevel(s) >= scopeLevel(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeLevel returns the position of scope in the order scopes include each
+// other, or -1 for an unknown scope.
+func scopeLevel(scope TokenScope) int {
+	return slices.Index([]TokenScope{ScopeRead, ScopeVote, ScopeAdmin}, scope)
+}
+
+// hashToken returns the hash API tokens and password reset tokens are stored
+// as.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// joinScopes returns scopes as stored in the api_tokens table.
+func joinScopes(scopes []TokenScope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, ",")
+}
+
+// apiTokenColumns lists the api_tokens table columns in the order
+// scanAPIToken expects.
+const apiTokenColumns = `api_tokens.id, api_tokens.user_id, api_tokens.name, api_tokens.scopes,
+	api_tokens.created_at, api_tokens.last_used`
+
+// scanAPIToken reads an API token selected with apiTokenColumns.
+func scanAPIToken(row scanner) (*APIToken, error) {
+	token := APIToken{}
+	var scopes string
+	var lastUsed sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range strings.Split(scopes, ",") {
+		token.Scopes = append(token.Scopes, TokenScope(scope))
+	}
+	if lastUsed.Valid {
+		token.LastUsed = &lastUsed.Time
+	}
+	return &token, nil
+}
@@ -0,0 +1,8 @@
+/** @type {import('tailwindcss').Config} */
+module.exports = {
+  content: ["./*.templ"],
+  theme: {
+    extend: {},
+  },
+  plugins: [],
+};
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VotingMethod selects how the ballots of a round are counted.
+type VotingMethod string
+
+const (
+	// MethodApproval counts one point for every song a user voted for.
+	MethodApproval VotingMethod = "approval"
+	// MethodLimited is approval voting where each ballot may only name a
+	// limited number of songs. Choices beyond the limit are ignored.
+	MethodLimited VotingMethod = "limited"
+	// MethodRanked is instant-runoff voting on ordered ballots.
+	MethodRanked VotingMethod = "ranked"
+	// MethodBorda awards each song points based on its position on ordered
+	// ballots.
+	MethodBorda VotingMethod = "borda"
+)
+
+// Ballot is a single user's choices in a round, most preferred first. For
+// approval and limited voting the order doesn't matter.
+type Ballot struct {
+	UserID  int64   `json:"user_id"`
+	Choices []int64 `json:"choices"`
+}
+
+// SongScore is a song's final score in a tally.
+type SongScore struct {
+	SongID int64 `json:"song_id"`
+	Score  int   `json:"score"`
+}
+
+// TallyResult is the outcome of counting a round's ballots. Ranking lists
+// every candidate song, winner first.
+type TallyResult struct {
+	RoundID int64        `json:"round_id"`
+	Method  VotingMethod `json:"voting_method"`
+	Ballots int          `json:"ballots"`
+	Ranking []SongScore  `json:"ranking"`
+}
+
+// tallyFunc counts ballots for the given candidates, which are ordered by
+// precedence for breaking ties. limit is the maximum number of choices
+// counted per ballot, where the method uses one.
+type tallyFunc func(candidates []int64, ballots []Ballot, limit int) []SongScore
+
+// tallyMethods maps each voting method to its counting strategy.
+var tallyMethods = map[VotingMethod]tallyFunc{
+	MethodApproval: tallyApproval,
+	MethodLimited:  tallyLimited,
+	MethodRanked:   tallyInstantRunoff,
+	MethodBorda:    tallyBorda,
+}
+
+// validVotingMethod returns true if method has a counting strategy.
+func validVotingMethod(method VotingMethod) bool {
+	_, ok := tallyMethods[method]
+	return ok
+}
+
+// Tally counts ballots with the given method. Candidates must be ordered by
+// precedence: when two songs tie, the one that comes first in candidates
+// ranks higher. Choices for songs that aren't candidates are ignored, as are
+// repeated choices on the same ballot.
+func Tally(method VotingMethod, candidates []int64, ballots []Ballot, limit int) (*TallyResult, error) {
+	tally, ok := tallyMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown voting method %q", method)
+	}
+
+	cleaned := make([]Ballot, 0, len(ballots))
+	for _, b := range ballots {
+		cleaned = append(cleaned, Ballot{b.UserID, validChoices(candidates, b.Choices)})
+	}
+
+	return &TallyResult{
+		Method:  method,
+		Ballots: len(ballots),
+		Ranking: tally(candidates, cleaned, limit),
+	}, nil
+}
+
+// validChoices returns choices without repeats or songs that aren't
+// candidates, keeping their order.
+func validChoices(candidates, choices []int64) []int64 {
+	valid := make(map[int64]bool, len(candidates))
+	for _, c := range candidates {
+		valid[c] = true
+	}
+
+	result := []int64{}
+	for _, c := range choices {
+		if valid[c] {
+			result = append(result, c)
+			valid[c] = false
+		}
+	}
+	return result
+}
+
+// tallyApproval gives each song one point per ballot naming it.
+func tallyApproval(candidates []int64, ballots []Ballot, _ int) []SongScore {
+	return tallyLimited(candidates, ballots, 0)
+}
+
+// tallyLimited gives each song one point per ballot naming it among the
+// first limit choices. A limit of zero or less counts every choice.
+func tallyLimited(candidates []int64, ballots []Ballot, limit int) []SongScore {
+	points := map[int64]int{}
+	for _, b := range ballots {
+		choices := b.Choices
+		if limit > 0 && len(choices) > limit {
+			choices = choices[:limit]
+		}
+		for _, c := range choices {
+			points[c]++
+		}
+	}
+	return rankByPoints(candidates, points)
+}
+
+// tallyBorda gives each song n-1 points for a first choice, n-2 for a second
+// choice and so on, where n is the number of candidates. Songs left off a
+// ballot get no points from it.
+func tallyBorda(candidates []int64, ballots []Ballot, _ int) []SongScore {
+	points := map[int64]int{}
+	for _, b := range ballots {
+		for i, c := range b.Choices {
+			points[c] += len(candidates) - 1 - i
+		}
+	}
+	return rankByPoints(candidates, points)
+}
+
+// tallyInstantRunoff repeatedly counts each ballot for its highest choice
+// still in the running and eliminates the song with the fewest votes, until
+// one song holds a majority of the ballots that are not exhausted. Ties for
+// elimination knock out the song with the lowest precedence. The winner is
+// ranked first, followed by the other songs in reverse order of elimination,
+// each scored with its votes in the last count it took part in.
+func tallyInstantRunoff(candidates []int64, ballots []Ballot, _ int) []SongScore {
+	remaining := append([]int64{}, candidates...)
+	eliminated := []SongScore{}
+
+	for len(remaining) > 0 {
+		running := map[int64]bool{}
+		for _, c := range remaining {
+			running[c] = true
+		}
+
+		votes := map[int64]int{}
+		total := 0
+		for _, b := range ballots {
+			for _, c := range b.Choices {
+				if running[c] {
+					votes[c]++
+					total++
+					break
+				}
+			}
+		}
+
+		ranked := rankByPoints(remaining, votes)
+		if len(ranked) == 1 || ranked[0].Score*2 > total {
+			result := append([]SongScore{}, ranked...)
+			for i := len(eliminated) - 1; i >= 0; i-- {
+				result = append(result, eliminated[i])
+			}
+			return result
+		}
+
+		// rankByPoints keeps precedence order among equal scores, so the
+		// last song is the one to eliminate.
+		loser := ranked[len(ranked)-1]
+		eliminated = append(eliminated, loser)
+		for i, c := range remaining {
+			if c == loser.SongID {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return []SongScore{}
+}
+
+// rankByPoints orders candidates by points, highest first, keeping candidate
+// order among songs with equal points.
+func rankByPoints(candidates []int64, points map[int64]int) []SongScore {
+	ranking := make([]SongScore, 0, len(candidates))
+	for _, c := range candidates {
+		ranking = append(ranking, SongScore{c, points[c]})
+	}
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return ranking[i].Score > ranking[j].Score
+	})
+	return ranking
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTally(t *testing.T) {
+	candidates := []int64{1, 2, 3}
+
+	t.Run("unknown method fails", func(t *testing.T) {
+		_, err := Tally("plurality", candidates, nil, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("ignores repeated and unknown choices", func(t *testing.T) {
+		ballots := []Ballot{{1, []int64{2, 2, 99, 3}}}
+		result, err := Tally(MethodApproval, candidates, ballots, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Ballots)
+		assert.Equal(t, []SongScore{{2, 1}, {3, 1}, {1, 0}}, result.Ranking)
+	})
+
+	t.Run("no ballots keeps candidate order", func(t *testing.T) {
+		for method := range tallyMethods {
+			result, err := Tally(method, candidates, nil, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, []SongScore{{1, 0}, {2, 0}, {3, 0}}, result.Ranking, method)
+		}
+	})
+}
+
+func TestTallyApproval(t *testing.T) {
+	candidates := []int64{1, 2, 3}
+
+	t.Run("counts every choice", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{1, 2}},
+			{2, []int64{2, 3}},
+			{3, []int64{2}},
+		}
+		ranking := tallyApproval(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{2, 3}, {1, 1}, {3, 1}}, ranking)
+	})
+
+	t.Run("ties go to the earlier candidate", func(t *testing.T) {
+		ballots := []Ballot{{1, []int64{3}}, {2, []int64{1}}}
+		ranking := tallyApproval(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{1, 1}, {3, 1}, {2, 0}}, ranking)
+	})
+}
+
+func TestTallyLimited(t *testing.T) {
+	candidates := []int64{1, 2, 3}
+
+	t.Run("ignores choices beyond the limit", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{3, 1, 2}},
+			{2, []int64{2, 3}},
+		}
+		ranking := tallyLimited(candidates, ballots, 1)
+		assert.Equal(t, []SongScore{{2, 1}, {3, 1}, {1, 0}}, ranking)
+	})
+
+	t.Run("zero limit counts every choice", func(t *testing.T) {
+		ballots := []Ballot{{1, []int64{3, 1, 2}}}
+		ranking := tallyLimited(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{1, 1}, {2, 1}, {3, 1}}, ranking)
+	})
+}
+
+func TestTallyInstantRunoff(t *testing.T) {
+	candidates := []int64{1, 2, 3}
+
+	t.Run("majority of first choices wins outright", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{2, 1}},
+			{2, []int64{2, 3}},
+			{3, []int64{1, 2}},
+		}
+		ranking := tallyInstantRunoff(candidates, ballots, 0)
+		assert.Equal(t, SongScore{2, 2}, ranking[0])
+		assert.Equal(t, 3, len(ranking))
+	})
+
+	t.Run("transfers votes of eliminated songs", func(t *testing.T) {
+		// 1 leads on first choices, but 3 is eliminated and its voters
+		// prefer 2.
+		ballots := []Ballot{
+			{1, []int64{1}},
+			{2, []int64{1}},
+			{3, []int64{2}},
+			{4, []int64{2}},
+			{5, []int64{3, 2}},
+		}
+		ranking := tallyInstantRunoff(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{2, 3}, {1, 2}, {3, 1}}, ranking)
+	})
+
+	t.Run("exhausted ballots don't count towards the majority", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{1}},
+			{2, []int64{2}},
+			{3, []int64{2}},
+			{4, []int64{3}},
+		}
+		ranking := tallyInstantRunoff(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{2, 2}, {1, 1}, {3, 1}}, ranking)
+	})
+
+	t.Run("ties for elimination knock out the later candidate", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{1}},
+			{2, []int64{2, 1}},
+			{3, []int64{3, 2}},
+		}
+		// 3 is eliminated first and transfers to 2, which then beats 1.
+		ranking := tallyInstantRunoff(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{2, 2}, {1, 1}, {3, 1}}, ranking)
+	})
+
+	t.Run("final tie goes to the earlier candidate", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{2}},
+			{2, []int64{1}},
+		}
+		ranking := tallyInstantRunoff(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{1, 1}, {2, 1}, {3, 0}}, ranking)
+	})
+}
+
+func TestTallyBorda(t *testing.T) {
+	candidates := []int64{1, 2, 3}
+
+	t.Run("awards points by position", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{1, 2, 3}},
+			{2, []int64{2, 3, 1}},
+			{3, []int64{2, 1}},
+		}
+		// 1: 2+0+1, 2: 1+2+2, 3: 0+1+0
+		ranking := tallyBorda(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{2, 5}, {1, 3}, {3, 1}}, ranking)
+	})
+
+	t.Run("ties go to the earlier candidate", func(t *testing.T) {
+		ballots := []Ballot{
+			{1, []int64{3, 1}},
+			{2, []int64{1, 3}},
+		}
+		ranking := tallyBorda(candidates, ballots, 0)
+		assert.Equal(t, []SongScore{{1, 3}, {3, 3}, {2, 0}}, ranking)
+	})
+}
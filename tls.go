@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TLSConfig configures serving over HTTPS.
+type TLSConfig struct {
+	CertFile     string // PEM certificate chain, reloaded when it changes
+	KeyFile      string // PEM private key of the certificate
+	MinVersion   uint16 // oldest TLS version accepted, TLS 1.2 if zero
+	RedirectAddr string // address to redirect HTTP requests to HTTPS from, none if empty
+}
+
+// certPollInterval is how often the certificate files are checked for
+// changes.
+const certPollInterval = 10 * time.Second
+
+// EnableTLS serves the app over HTTPS. The session cookie is then only sent
+// over HTTPS.
+func (s *Server) EnableTLS(config TLSConfig) {
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	s.tls = &config
+	s.sessionManager.Cookie.Secure = true
+}
+
+// ParseTLSVersion returns the TLS version with the given number, such as
+// "1.3".
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// listenAndServeTLS serves the app over HTTPS with the certificate reloaded
+// when its files change or on SIGHUP, and redirects HTTP requests to HTTPS if
+// configured to.
+func (s *Server) listenAndServeTLS() error {
+	certs, err := newCertReloader(s.tls.CertFile, s.tls.KeyFile)
+	if err != nil {
+		return err
+	}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go certs.watch(context.Background(), certPollInterval, reload)
+
+	if s.tls.RedirectAddr != "" {
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "port", s.tls.RedirectAddr)
+			err := http.ListenAndServe(s.tls.RedirectAddr, redirectToHTTPS(s.port))
+			slog.Error("HTTP redirect stopped", "error", err)
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      s.port,
+		Handler:   s.routes(),
+		TLSConfig: s.tlsConfig(certs),
+	}
+	slog.Info("Server listening with TLS", "port", s.port)
+	return server.ListenAndServeTLS("", "")
+}
+
+// tlsConfig returns the TLS settings of the server, getting the certificate
+// from certs on each handshake.
+func (s *Server) tlsConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     s.tls.MinVersion,
+		GetCertificate: certs.getCertificate,
+	}
+}
+
+// redirectToHTTPS redirects requests to the same URL over HTTPS on the host's
+// port httpsPort.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if _, port, err := net.SplitHostPort(httpsPort); err == nil && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// certReloader holds a certificate loaded from files, and loads it again
+// when the files change.
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modTime           time.Time // latest modification time of the files loaded
+}
+
+// newCertReloader loads the certificate in certFile with the key in keyFile.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// reload loads the certificate files. The certificate loaded before is kept
+// if they can't be loaded.
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged loads the certificate files if they changed since they were
+// last loaded, and reports whether they did.
+func (c *certReloader) reloadIfChanged() (bool, error) {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, c.reload()
+}
+
+// filesModTime returns the latest modification time of the certificate files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, fmt.Errorf("error reading certificate: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate when its files change, checking every
+// interval, or when reload receives, until ctx is done.
+func (c *certReloader) watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if err := c.reload(); err != nil {
+				slog.Error("error reloading certificate", "error", err)
+				continue
+			}
+			slog.Info("Certificate reloaded", "file", c.certFile)
+		case <-ticker.C:
+			changed, err := c.reloadIfChanged()
+			if err != nil {
+				slog.Error("error reloading certificate", "error", err)
+				continue
+			}
+			if changed {
+				slog.Info("Certificate reloaded", "file", c.certFile)
+			}
+		}
+	}
+}
+
+// getCertificate returns the certificate last loaded, for TLS handshakes.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
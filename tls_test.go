@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 with the
+// given common name, and its key, to dir. It returns the certificate.
+func writeSelfSignedCert(t *testing.T, dir, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "cert.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return cert
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeSelfSignedCert(t, dir, "first")
+
+	store, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	server := NewServer("127.0.0.1:0", store)
+	server.EnableTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS13})
+
+	certs, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go http.Serve(tls.NewListener(listener, server.tlsConfig(certs)), server.routes())
+	t.Cleanup(func() { listener.Close() })
+
+	// handshake connects to the server trusting cert and returns the
+	// certificate the server presents.
+	handshake := func(t *testing.T, cert *x509.Certificate, maxVersion uint16) (*x509.Certificate, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{RootCAs: roots, MaxVersion: maxVersion})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	t.Run("serves the app over HTTPS", func(t *testing.T) {
+		roots := x509.NewCertPool()
+		roots.AddCert(first)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+		resp, err := client.Get("https://" + listener.Addr().String() + "/healthz")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Strict-Transport-Security"))
+		assert.True(t, server.sessionManager.Cookie.Secure)
+	})
+
+	t.Run("rejects TLS versions below the minimum", func(t *testing.T) {
+		_, err := handshake(t, first, tls.VersionTLS12)
+		assert.Error(t, err)
+	})
+
+	t.Run("reloads the certificate when its files change", func(t *testing.T) {
+		changed, err := certs.reloadIfChanged()
+		assert.NoError(t, err)
+		assert.False(t, changed)
+
+		second := writeSelfSignedCert(t, dir, "second")
+		later := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(certFile, later, later))
+
+		changed, err = certs.reloadIfChanged()
+		assert.NoError(t, err)
+		assert.True(t, changed)
+
+		presented, err := handshake(t, second, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "second", presented.Subject.CommonName)
+	})
+
+	third := writeSelfSignedCert(t, dir, "third")
+
+	t.Run("reloads the certificate on signal", func(t *testing.T) {
+		// Keep the modification time, so only the signal reloads the files.
+		later := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(certFile, later, later))
+		certs.modTime = later
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		reload := make(chan os.Signal)
+		go certs.watch(ctx, time.Hour, reload)
+		reload <- os.Interrupt
+
+		assert.Eventually(t, func() bool {
+			presented, err := handshake(t, third, 0)
+			return err == nil && presented.Subject.CommonName == "third"
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("keeps the certificate if the new one can't be loaded", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0o600))
+		assert.Error(t, certs.reload())
+
+		presented, err := handshake(t, third, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "third", presented.Subject.CommonName)
+	})
+
+	t.Run("redirects HTTP to HTTPS", func(t *testing.T) {
+		ts := httptest.NewServer(redirectToHTTPS(":8443"))
+		t.Cleanup(ts.Close)
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+
+		resp, err := client.Get(ts.URL + "/user/1?tab=songs")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		assert.Equal(t, "https://127.0.0.1:8443/user/1?tab=songs", resp.Header.Get("Location"))
+	})
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	_, err = ParseTLSVersion("1.4")
+	assert.Error(t, err)
+}
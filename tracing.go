@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tracerName identifies the spans of the app.
+const tracerName = "github.com/et-codes/songvote"
+
+// configureTracing sets the global tracer provider to export spans to
+// "stdout" or to an "otlp" collector over HTTP, configured with the standard
+// OTEL_EXPORTER_OTLP_* variables. An empty exporter keeps tracing disabled,
+// though trace IDs sent by clients are still passed on. The returned function
+// flushes the spans not exported yet.
+func configureTracing(exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, use stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("songvote"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracer returns the tracer of the global tracer provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// setSpanAttributes adds attributes to the span of a request.
+func setSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// Attributes of request spans.
+var (
+	songIDKey    = attribute.Key("songvote.song.id")
+	requestIDKey = attribute.Key("songvote.request.id")
+)
+
+// timedDB is a database handle that records how long queries take, labelled
+// with the first keyword of the statement, and traces each query as part of
+// the request the handle is used for.
+type timedDB struct {
+	*sql.DB
+	ctx context.Context // context of the request, only used for tracing
+}
+
+func (db *timedDB) Exec(query string, args ...any) (sql.Result, error) {
+	defer startQuery(db.ctx, query)()
+	return db.DB.Exec(query, args...)
+}
+
+func (db *timedDB) Query(query string, args ...any) (*timedRows, error) {
+	end := startQuery(db.ctx, query)
+	rows, err := db.DB.Query(query, args...)
+	return newTimedRows(rows, err, end)
+}
+
+func (db *timedDB) QueryRow(query string, args ...any) *timedRow {
+	end := startQuery(db.ctx, query)
+	return &timedRow{Row: db.DB.QueryRow(query, args...), end: end}
+}
+
+// Begin starts a transaction whose queries are timed and traced too.
+func (db *timedDB) Begin() (*timedTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &timedTx{Tx: tx, ctx: db.ctx}, nil
+}
+
+// timedTx is a transaction that times and traces its queries like timedDB.
+type timedTx struct {
+	*sql.Tx
+	ctx context.Context
+}
+
+func (tx *timedTx) Exec(query string, args ...any) (sql.Result, error) {
+	defer startQuery(tx.ctx, query)()
+	return tx.Tx.Exec(query, args...)
+}
+
+func (tx *timedTx) Query(query string, args ...any) (*timedRows, error) {
+	end := startQuery(tx.ctx, query)
+	rows, err := tx.Tx.Query(query, args...)
+	return newTimedRows(rows, err, end)
+}
+
+func (tx *timedTx) QueryRow(query string, args ...any) *timedRow {
+	end := startQuery(tx.ctx, query)
+	return &timedRow{Row: tx.Tx.QueryRow(query, args...), end: end}
+}
+
+// timedRows are the rows of a timed query. SQLite does most of the work of a
+// query while its rows are read, so the query ends when the rows are closed,
+// or when Next runs out of them.
+type timedRows struct {
+	*sql.Rows
+	end func()
+}
+
+// newTimedRows returns the rows of a query ended by end, or ends it at once if
+// the query failed.
+func newTimedRows(rows *sql.Rows, err error, end func()) (*timedRows, error) {
+	if err != nil {
+		end()
+		return nil, err
+	}
+	return &timedRows{Rows: rows, end: end}, nil
+}
+
+func (rows *timedRows) Next() bool {
+	if rows.Rows.Next() {
+		return true
+	}
+	rows.stop()
+	return false
+}
+
+func (rows *timedRows) Close() error {
+	err := rows.Rows.Close()
+	rows.stop()
+	return err
+}
+
+// stop ends the query the first time it is called.
+func (rows *timedRows) stop() {
+	if rows.end != nil {
+		rows.end()
+		rows.end = nil
+	}
+}
+
+// timedRow is the row of a timed query, which ends once the row is scanned.
+type timedRow struct {
+	*sql.Row
+	end func()
+}
+
+func (row *timedRow) Scan(dest ...any) error {
+	defer row.end()
+	return row.Row.Scan(dest...)
+}
+
+// startQuery starts timing and tracing a query, and returns the function that
+// ends it.
+func startQuery(ctx context.Context, query string) func() {
+	start := time.Now()
+	query = strings.Join(strings.Fields(query), " ")
+	statement, _, _ := strings.Cut(query, " ")
+	statement = strings.ToLower(statement)
+
+	_, span := tracer().Start(ctx, "db "+statement,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemSqlite, semconv.DBOperation(statement),
+			semconv.DBStatement(query)))
+
+	return func() {
+		queryDuration.observe(time.Since(start).Seconds(), statement)
+		span.End()
+	}
+}
+
+// hashPassword hashes a password with bcrypt, traced as part of ctx.
+func hashPassword(ctx context.Context, password string) ([]byte, error) {
+	_, span := tracer().Start(ctx, "bcrypt hash")
+	defer span.End()
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// comparePassword checks a password against its bcrypt hash, traced as part
+// of ctx.
+func comparePassword(ctx context.Context, hash []byte, password string) error {
+	_, span := tracer().Start(ctx, "bcrypt compare")
+	defer span.End()
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// endRequestSpan records the outcome of a request on its span and ends it.
+func endRequestSpan(span trace.Span, status int, userID int64) {
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if userID != 0 {
+		span.SetAttributes(semconv.EnduserID(fmt.Sprint(userID)))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+	}
+	span.End()
+}
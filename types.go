@@ -1,15 +1,96 @@
 package main
 
-const initialVetoes = 1
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	initialVetoes     = 1
+	favoriteArtists   = 5  // number of artists listed in a user profile
+	leaderboardSize   = 10 // number of entries in each analytics list
+	defaultVoteBudget = 5  // votes per user in a round unless configured
+	defaultSongQuota  = 3  // songs per user in a round unless configured
+	defaultGroupID    = 1  // group every user belongs to
+	defaultGroupName  = "SongVote"
+
+	// How long a password reset token can be used.
+	passwordResetLifetime = time.Hour
+
+	// How long a session lasts after it was last used.
+	sessionLifetime = 24 * time.Hour
+
+	// How often the last seen time of a session is updated.
+	sessionSeenInterval = time.Minute
+
+	auditPageSize    = 100  // audit entries returned unless a limit is given
+	auditMaxPageSize = 1000 // most audit entries returned at once
+
+	// Share of active users needed to lift a veto unless configured.
+	defaultVetoOverrideFraction = 2.0 / 3.0
+)
+
+// Login throttling. Each failed login past the free ones makes the user name
+// and address wait twice as long as the previous one before trying again,
+// until they are locked out. Failures for a user name from any address only
+// make it wait up to loginUserMaxWait, so nobody can lock a user out by name.
+const (
+	loginFreeFailures  = 3                // failed logins allowed without waiting
+	loginBaseDelay     = time.Second      // wait after the first failure past the free ones
+	loginMaxFailures   = 10               // failed logins that cause a lockout
+	loginLockout       = 15 * time.Minute // how long a lockout lasts
+	loginUserMaxWait   = 30 * time.Second // longest wait for a user name from any address
+	loginFailureWindow = time.Hour        // failures are forgotten this long after the last one
+)
+
+// Timestamps record when an entity was created, last updated and deleted.
+// They are nil for rows from before they were tracked, and DeletedAt is nil
+// unless the entity was soft deleted.
+type Timestamps struct {
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// TimeRange selects times from Since up to but not including Until. A zero
+// bound leaves that end of the range open.
+type TimeRange struct {
+	Since time.Time
+	Until time.Time
+}
 
 // User types
 
+// User is a SongVote account. Vetoes and VotesRemaining are what the user has
+// left in the default group; see Member for other groups.
 type User struct {
-	ID       int64  `json:"id"`
-	Name     string `json:"name"`
-	Password string `json:"password,omitempty"`
-	Inactive bool   `json:"inactive"`
-	Vetoes   int    `json:"vetoes"`
+	Timestamps
+	ID             int64  `json:"id"`
+	Name           string `json:"name"`
+	Password       string `json:"password,omitempty"`
+	Inactive       bool   `json:"inactive"`
+	Admin          bool   `json:"admin"`
+	SessionVersion int    `json:"-"` // incremented to end the user's sessions
+	Vetoes         int    `json:"vetoes"`
+	VotesRemaining int    `json:"votes_remaining"`
+}
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// CurrentUser is the logged in user with their role and what they have left
+// to spend in the current round of each of their groups. Vetoes,
+// VotesRemaining and SongsRemaining are for the default group.
+type CurrentUser struct {
+	ID             int64        `json:"id"`
+	Name           string       `json:"name"`
+	Role           string       `json:"role"`
+	Vetoes         int          `json:"vetoes"`
+	VotesRemaining int          `json:"votes_remaining"`
+	SongsRemaining int          `json:"songs_remaining"`
+	Groups         []Membership `json:"groups"`
 }
 
 type NewUserRequest struct {
@@ -17,6 +98,14 @@ type NewUserRequest struct {
 	Password string `json:"password"`
 }
 
+// UpdateUserRequest changes a user. Vetoes are left as they are when missing.
+type UpdateUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Inactive bool   `json:"inactive"`
+	Vetoes   *int   `json:"vetoes"`
+}
+
 type NewUserResponse struct {
 	ID   int64  `json:"id"`
 	Name string `json:"name"`
@@ -25,6 +114,7 @@ type NewUserResponse struct {
 // Song types
 
 type Song struct {
+	Timestamps
 	ID      int64  `json:"id"`
 	Title   string `json:"title"`
 	Artist  string `json:"artist"`
@@ -32,9 +122,12 @@ type Song struct {
 	Votes   int    `json:"votes"`
 	Vetoed  bool   `json:"vetoed"`
 	AddedBy int64  `json:"added_by"`
+	RoundID int64  `json:"round_id"`
+	GroupID int64  `json:"group_id"`
 }
 
 type NewSongRequest struct {
+	GroupID int64  `json:"group_id"`
 	AddedBy int64  `json:"added_by"`
 	Title   string `json:"title"`
 	Artist  string `json:"artist"`
@@ -44,6 +137,7 @@ type NewSongRequest struct {
 // Vote types
 
 type Vote struct {
+	Timestamps
 	ID     int64 `json:"id"`
 	SongID int64 `json:"song_id"`
 	UserID int64 `json:"user_id"`
@@ -57,6 +151,7 @@ type VoteRequest struct {
 // Veto types
 
 type Veto struct {
+	Timestamps
 	ID     int64 `json:"id"`
 	SongID int64 `json:"song_id"`
 	UserID int64 `json:"user_id"`
@@ -66,3 +161,341 @@ type VetoRequest struct {
 	SongID int64 `json:"song_id"`
 	UserID int64 `json:"user_id"`
 }
+
+// Override is a user's vote to lift the veto of a song.
+type Override struct {
+	ID     int64 `json:"id"`
+	SongID int64 `json:"song_id"`
+	UserID int64 `json:"user_id"`
+}
+
+type OverrideRequest struct {
+	SongID int64 `json:"song_id"`
+	UserID int64 `json:"user_id"`
+}
+
+// OverrideResponse reports the progress of a vote to lift a veto.
+type OverrideResponse struct {
+	SongID   int64 `json:"song_id"`
+	Votes    int   `json:"votes"`
+	Required int   `json:"required"`
+	Lifted   bool  `json:"lifted"`
+}
+
+// Round types
+
+type Round struct {
+	ID                   int64        `json:"id"`
+	GroupID              int64        `json:"group_id"`
+	Closed               bool         `json:"closed"`
+	VotingMethod         VotingMethod `json:"voting_method"`
+	VoteBudget           int          `json:"vote_budget"`
+	VetoOverrideFraction float64      `json:"veto_override_fraction"`
+	VetoOverrideRefund   bool         `json:"veto_override_refund"`
+}
+
+// RoundRequest changes the settings of the open round. Empty fields are left
+// unchanged.
+type RoundRequest struct {
+	VotingMethod         VotingMethod `json:"voting_method,omitempty"`
+	VoteBudget           int          `json:"vote_budget,omitempty"`
+	VetoOverrideFraction float64      `json:"veto_override_fraction,omitempty"`
+	VetoOverrideRefund   *bool        `json:"veto_override_refund,omitempty"`
+}
+
+// Ballot types
+
+type BallotRequest struct {
+	GroupID int64   `json:"group_id"`
+	UserID  int64   `json:"user_id"`
+	Choices []int64 `json:"choices"`
+}
+
+// RoundBallot is the ballot a user submitted in a round, most preferred
+// choice first.
+type RoundBallot struct {
+	RoundID int64   `json:"round_id"`
+	Choices []int64 `json:"choices"`
+}
+
+// Group types
+
+const (
+	RoleOwner  = "owner"
+	RoleMember = "member"
+)
+
+// Group is a set of users sharing songs, rounds and settings. The invite code
+// is only shown to members.
+type Group struct {
+	ID            int64        `json:"id"`
+	Name          string       `json:"name"`
+	InviteCode    string       `json:"invite_code,omitempty"`
+	VetoAllowance int          `json:"veto_allowance"`
+	SongQuota     int          `json:"song_quota"`
+	VotingMethod  VotingMethod `json:"voting_method"`
+}
+
+// GroupRequest creates a group or changes its settings. Empty fields get
+// defaults on creation and are left unchanged on update.
+type GroupRequest struct {
+	Name          string       `json:"name,omitempty"`
+	VetoAllowance int          `json:"veto_allowance,omitempty"`
+	SongQuota     int          `json:"song_quota,omitempty"`
+	VotingMethod  VotingMethod `json:"voting_method,omitempty"`
+}
+
+type JoinGroupRequest struct {
+	InviteCode string `json:"invite_code"`
+}
+
+// Member is a user's membership of a group and what they have left to spend
+// in the group's current round.
+type Member struct {
+	GroupID        int64  `json:"group_id"`
+	UserID         int64  `json:"user_id"`
+	Name           string `json:"name"`
+	Role           string `json:"role"`
+	Vetoes         int    `json:"vetoes"`
+	VotesRemaining int    `json:"votes_remaining"`
+}
+
+// Membership is one of the logged in user's groups.
+type Membership struct {
+	Member
+	GroupName      string `json:"group_name"`
+	SongsRemaining int    `json:"songs_remaining"`
+}
+
+// Profile types
+
+type UserProfile struct {
+	User
+	SongsAdded      int           `json:"songs_added"`
+	SongsApproved   int           `json:"songs_approved"`
+	SongsVetoed     int           `json:"songs_vetoed"`
+	VotesCast       int           `json:"votes_cast"`
+	VetoesUsed      int           `json:"vetoes_used"`
+	AgreementRate   float64       `json:"agreement_rate"`
+	FavoriteArtists []ArtistCount `json:"favorite_artists"`
+}
+
+type ArtistCount struct {
+	Artist string `json:"artist"`
+	Count  int    `json:"count"`
+}
+
+// Analytics types
+
+type Analytics struct {
+	TopContributors []UserCount          `json:"top_contributors"`
+	MostVetoed      []UserCount          `json:"most_vetoed"`
+	PopularArtists  []ArtistCount        `json:"popular_artists"`
+	Participation   []RoundParticipation `json:"participation"`
+	Controversial   []*Song              `json:"controversial"`
+}
+
+type UserCount struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+}
+
+type RoundParticipation struct {
+	RoundID int64   `json:"round_id"`
+	Songs   int     `json:"songs"`
+	Votes   int     `json:"votes"`
+	Voters  int     `json:"voters"`
+	Rate    float64 `json:"rate"`
+}
+
+// Signup types
+
+// SignupMode controls who can register a new account.
+type SignupMode string
+
+const (
+	SignupOpen     SignupMode = "open"     // anyone can register
+	SignupInvite   SignupMode = "invite"   // registering needs an invite token
+	SignupDisabled SignupMode = "disabled" // nobody can register
+)
+
+type SignupSettings struct {
+	Mode SignupMode `json:"mode"`
+}
+
+// Invite lets someone register while signup is invite-only. A single-use
+// invite is spent by its first redemption; an expiring one can be redeemed
+// until it expires.
+type Invite struct {
+	ID          int64              `json:"id"`
+	Token       string             `json:"token"`
+	CreatedBy   int64              `json:"created_by"`
+	CreatedAt   time.Time          `json:"created_at"`
+	SingleUse   bool               `json:"single_use"`
+	ExpiresAt   *time.Time         `json:"expires_at,omitempty"`
+	Redemptions []InviteRedemption `json:"redemptions"`
+}
+
+// InviteRequest creates an invite. ExpiresIn is the number of hours until the
+// invite expires, or zero for an invite that doesn't expire, which must then
+// be single-use.
+type InviteRequest struct {
+	SingleUse bool `json:"single_use"`
+	ExpiresIn int  `json:"expires_in"`
+}
+
+// InviteRedemption records a user who registered with an invite.
+type InviteRedemption struct {
+	UserID     int64     `json:"user_id"`
+	Name       string    `json:"name"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// API token types
+
+// TokenScope is what an API token can be used for. Each scope includes the
+// ones before it: read, vote, admin. The account scope isn't included by any
+// other, so tokens only manage users and groups when given it explicitly.
+type TokenScope string
+
+const (
+	ScopeRead    TokenScope = "read"    // read-only requests
+	ScopeVote    TokenScope = "vote"    // adding songs, voting and other changes
+	ScopeAdmin   TokenScope = "admin"   // admin requests, for admins only
+	ScopeAccount TokenScope = "account" // updating and deleting users, managing groups
+)
+
+// APIToken lets scripts make requests on behalf of a user. The token itself is
+// only shown when it is created.
+type APIToken struct {
+	ID        int64        `json:"id"`
+	UserID    int64        `json:"user_id"`
+	Name      string       `json:"name"`
+	Scopes    []TokenScope `json:"scopes"`
+	Token     string       `json:"token,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	LastUsed  *time.Time   `json:"last_used,omitempty"`
+}
+
+type APITokenRequest struct {
+	Name   string       `json:"name"`
+	Scopes []TokenScope `json:"scopes"`
+}
+
+// Password types
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// PasswordReset is a token letting a user set a new password without knowing
+// the current one. The token is only shown when it is created.
+type PasswordReset struct {
+	UserID    int64     `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// Session types
+
+// Session is a logged in session of a user. Current marks the session the
+// request was made with.
+type Session struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+// Audit types
+
+// Audit actions, named after the target type and what happened to it.
+const (
+	AuditUserCreate     = "user.create"
+	AuditUserUpdate     = "user.update"
+	AuditUserDelete     = "user.delete"
+	AuditUserErase      = "user.erase"
+	AuditPasswordChange = "password.change"
+	AuditPasswordReset  = "password.reset"
+	AuditSongCreate     = "song.create"
+	AuditVoteCreate     = "vote.create"
+	AuditVoteDelete     = "vote.delete"
+	AuditBallotSubmit   = "ballot.submit"
+	AuditVetoCreate     = "veto.create"
+	AuditVetoOverride   = "veto.override"
+	AuditRoundStart     = "round.start"
+	AuditRoundUpdate    = "round.update"
+)
+
+// Audit target types.
+const (
+	AuditTargetUser  = "user"
+	AuditTargetSong  = "song"
+	AuditTargetRound = "round"
+)
+
+// AuditEntry records a state-changing action. Before and After are JSON
+// snapshots of what changed, null if it didn't exist before or after. ActorID
+// is 0 for actions taken without logging in. Entries are never changed, except
+// that the snapshots of erased users are set to null.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    int64           `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	RequestID  string          `json:"request_id"`
+}
+
+// AuditFilter selects audit entries. Zero fields match all entries.
+type AuditFilter struct {
+	TimeRange
+	ActorID    int64
+	Action     string
+	TargetType string
+	TargetID   int64
+	Limit      int
+}
+
+// Export types
+
+// UserExport is all the data kept about a user, for them to take with them.
+type UserExport struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	User       User          `json:"user"`
+	Groups     []Membership  `json:"groups"`
+	Songs      []Song        `json:"songs"`
+	Votes      []Vote        `json:"votes"`
+	Vetoes     []Veto        `json:"vetoes"`
+	Ballots    []RoundBallot `json:"ballots"`
+	Overrides  []Override    `json:"overrides"`
+	Sessions   []Session     `json:"sessions"`
+	APITokens  []APIToken    `json:"api_tokens"`
+}
+
+// Health types
+
+// Health check statuses.
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// Health is the status of the app, with the status or error of each check
+// that went into it.
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}